@@ -17,6 +17,8 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -31,19 +33,479 @@ type ApplicationSpec struct {
 	// Repository where the Application manifests are stored
 	Repository string `json:"repository,omitempty"`
 	// Ref pointer to track in the Repository
-	Ref string `json:"ref,omitempty"`
+	// +kubebuilder:validation:Required
+	Ref *GitReference `json:"ref,omitempty"`
+	// SecretRef points to a Secret in the namespace of the Application holding the credentials of the Repository.
+	// For HTTPS it can contain `username` and `password`, or a `bearerToken`. For SSH it has to contain an `identity`
+	// private key, an optional `password` for the key, and `known_hosts` to verify the host key of the server.
+	// +optional
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
+	// Path of the directory in the Repository holding the manifests, defaults to `kubernetes`. The directory is read
+	// recursively and only `.yaml`, `.yml` and `.json` files are considered. Subdirectories holding a kustomization or
+	// a Helm chart are skipped, and so are kustomization files and the `Chart.yaml`, `values.yaml` and
+	// `values.schema.json` files of charts.
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Include lists globs of the manifests to consider relative to Path, all of them if empty. Globs without a `/`
+	// match the file name, `**` matches any number of directories.
+	// +optional
+	Include []string `json:"include,omitempty"`
+	// Exclude lists globs of the manifests to ignore relative to Path, taking precedence over Include
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+	// Kustomize renders the manifests at Path with kustomize, even if there is no kustomization file, and applies the
+	// given overrides on top. A kustomization file at Path is rendered with kustomize even without this field.
+	// +optional
+	Kustomize *KustomizeSpec `json:"kustomize,omitempty"`
+	// Helm renders a Helm chart of the Repository instead of reading plain manifests
+	// +optional
+	Helm *HelmSpec `json:"helm,omitempty"`
+	// TargetNamespace is the namespace namespaced objects are applied to, overriding the namespace set in the
+	// manifests. Defaults to the namespace of the manifest, or the namespace of the Application if it has none
+	// +optional
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+	// CreateNamespace creates the namespaces objects are applied to if they do not exist yet
+	// +optional
+	CreateNamespace bool `json:"createNamespace,omitempty"`
+	// Interval at which the Repository is fetched and the manifests are synced, defaults to the --default-interval of
+	// the controller
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern=`^([0-9]+(\.[0-9]+)?(ms|s|m|h))+$`
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// RetryInterval is the delay before retrying a failed sync, doubled on every consecutive failure up to Interval.
+	// Defaults to 10s
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern=`^([0-9]+(\.[0-9]+)?(ms|s|m|h))+$`
+	// +optional
+	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
+	// HealthTimeout is how long the applied objects may take to become healthy after a change before the Application
+	// is reported unhealthy, defaults to 5m
+	// +optional
+	HealthTimeout *metav1.Duration `json:"healthTimeout,omitempty"`
+	// SyncPolicy decides whether changes are applied right away (auto) or only reported until the revision is approved
+	// with the approved-revision annotation (manual), defaults to auto
+	// +kubebuilder:validation:Enum=auto;manual
+	// +optional
+	SyncPolicy string `json:"syncPolicy,omitempty"`
+	// SelfHeal reverts changes made to the applied objects outside of the Repository. Drift is only reported in the
+	// Drifted condition if disabled. Defaults to true with the auto SyncPolicy and to false with the manual one, as
+	// reverting drift applies changes without an approval
+	// +optional
+	SelfHeal *bool `json:"selfHeal,omitempty"`
+	// DeletionPolicy decides what happens to the applied objects when the Application is deleted: Delete removes them in
+	// reverse apply order, Orphan leaves them in the cluster. Defaults to Delete
+	// +kubebuilder:validation:Enum=Delete;Orphan
+	// +optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// Suspend stops fetching the Repository and applying its manifests, leaving the objects in the cluster as they are
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+	// Prune deletes the objects that were applied previously but got removed from the Repository
+	// +optional
+	Prune bool `json:"prune,omitempty"`
+	// DependsOn lists the Applications that have to be Ready and Healthy at their latest revision before this one is synced
+	// +optional
+	DependsOn []ApplicationReference `json:"dependsOn,omitempty"`
+}
+
+// ApplicationReference points to another Application
+type ApplicationReference struct {
+	// Name of the Application
+	Name string `json:"name"`
+	// Namespace of the Application, defaults to the namespace of the referencing Application
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// GitReference selects what to check out from the Repository, exactly one of its fields has to be set
+// +kubebuilder:validation:MinProperties=1
+// +kubebuilder:validation:MaxProperties=1
+type GitReference struct {
+	// Branch to follow
+	// +optional
+	Branch string `json:"branch,omitempty"`
+	// Tag to check out
+	// +optional
+	Tag string `json:"tag,omitempty"`
+	// SemVer range, e.g. `>=1.2.0 <2.0.0`, checking out the tag with the highest matching version
+	// +optional
+	SemVer string `json:"semver,omitempty"`
+	// Commit SHA to check out, in its full 40 character form
+	// +kubebuilder:validation:Pattern=`^[0-9a-f]{40}$`
+	// +optional
+	Commit string `json:"commit,omitempty"`
+}
+
+// String returns a short description of the reference for logs and status, e.g. `branch/main`.
+func (in *GitReference) String() string {
+	if in == nil {
+		return ""
+	}
+
+	switch {
+	case in.Branch != "":
+		return "branch/" + in.Branch
+	case in.Tag != "":
+		return "tag/" + in.Tag
+	case in.SemVer != "":
+		return "semver/" + in.SemVer
+	case in.Commit != "":
+		return "commit/" + in.Commit
+	}
+
+	return ""
+}
+
+// KustomizeSpec holds overrides applied on top of the rendered kustomization
+type KustomizeSpec struct {
+	// Images to replace the name, tag or digest of
+	// +optional
+	Images []KustomizeImage `json:"images,omitempty"`
+	// NamePrefix to prepend to the names of all objects
+	// +optional
+	NamePrefix string `json:"namePrefix,omitempty"`
+	// CommonLabels to add to all objects and selectors
+	// +optional
+	CommonLabels map[string]string `json:"commonLabels,omitempty"`
+	// Patches to apply to the objects, either strategic merge or JSON 6902 patches
+	// +optional
+	Patches []KustomizePatch `json:"patches,omitempty"`
+}
+
+// KustomizeImage replaces the name, tag or digest of an image
+type KustomizeImage struct {
+	// Name of the image without tag
+	Name string `json:"name"`
+	// NewName replaces the name of the image
+	// +optional
+	NewName string `json:"newName,omitempty"`
+	// NewTag replaces the tag of the image
+	// +optional
+	NewTag string `json:"newTag,omitempty"`
+	// Digest replaces the tag of the image, taking precedence over NewTag
+	// +optional
+	Digest string `json:"digest,omitempty"`
+}
+
+// KustomizePatch is a strategic merge or JSON 6902 patch
+type KustomizePatch struct {
+	// Patch is the content of the patch
+	Patch string `json:"patch"`
+	// Target selects the objects to patch, it is required for JSON 6902 patches
+	// +optional
+	Target *KustomizeSelector `json:"target,omitempty"`
+}
+
+// KustomizeSelector selects the objects a patch applies to
+type KustomizeSelector struct {
+	// +optional
+	Group string `json:"group,omitempty"`
+	// +optional
+	Version string `json:"version,omitempty"`
+	// +optional
+	Kind string `json:"kind,omitempty"`
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// +optional
+	Name string `json:"name,omitempty"`
+	// AnnotationSelector is a label selector expression matched against the annotations of the objects
+	// +optional
+	AnnotationSelector string `json:"annotationSelector,omitempty"`
+	// LabelSelector is a label selector expression matched against the labels of the objects
+	// +optional
+	LabelSelector string `json:"labelSelector,omitempty"`
+}
+
+// HelmSpec describes how to render a Helm chart stored in the Repository
+type HelmSpec struct {
+	// Chart is the path of the chart directory in the Repository, defaults to Path
+	// +optional
+	Chart string `json:"chart,omitempty"`
+	// ReleaseName used when rendering the chart, defaults to the name of the Application
+	// +optional
+	ReleaseName string `json:"releaseName,omitempty"`
+	// ValuesFiles are paths of values files relative to the chart directory, merged in the given order on top of the
+	// default values of the chart
+	// +optional
+	ValuesFiles []string `json:"valuesFiles,omitempty"`
+	// ValuesFrom references Secrets and ConfigMaps in the namespace of the Application holding values, merged in the
+	// given order on top of ValuesFiles
+	// +optional
+	ValuesFrom []ValuesReference `json:"valuesFrom,omitempty"`
+	// Values merged on top of everything else
+	// +optional
+	Values *apiextensionsv1.JSON `json:"values,omitempty"`
+}
+
+// ValuesReference points to a key of a Secret or ConfigMap holding Helm values
+type ValuesReference struct {
+	// Kind of the object holding the values
+	// +kubebuilder:validation:Enum=Secret;ConfigMap
+	Kind string `json:"kind"`
+	// Name of the object holding the values
+	Name string `json:"name"`
+	// ValuesKey is the key holding the values, defaults to `values.yaml`
+	// +optional
+	ValuesKey string `json:"valuesKey,omitempty"`
+	// Optional references do not fail the sync if the object or the key is missing
+	// +optional
+	Optional bool `json:"optional,omitempty"`
+}
+
+// HelmReleaseStatus records the Helm release rendered for an Application
+type HelmReleaseStatus struct {
+	// ReleaseName the chart got rendered with
+	ReleaseName string `json:"releaseName"`
+	// ChartName of the rendered chart
+	ChartName string `json:"chartName"`
+	// ChartVersion of the rendered chart
+	ChartVersion string `json:"chartVersion"`
+	// Revision of the release, incremented every time the chart or its values change
+	Revision int `json:"revision"`
+	// Digest of the chart files and values the release got rendered from
+	Digest string `json:"digest"`
+}
+
+// ResourceReference identifies an object applied by an Application
+type ResourceReference struct {
+	// Group of the object, empty for the core API group
+	Group string `json:"group,omitempty"`
+	// Version of the object
+	Version string `json:"version"`
+	// Kind of the object
+	Kind string `json:"kind"`
+	// Namespace of the object, empty for cluster scoped objects
+	Namespace string `json:"namespace,omitempty"`
+	// Name of the object
+	Name string `json:"name"`
+}
+
+// Condition types reported in the status of an Application
+const (
+	// ReadyCondition is True when the last revision got synced and nothing needs attention
+	ReadyCondition = "Ready"
+	// SyncedCondition is True when all manifests of the last attempted revision got applied
+	SyncedCondition = "Synced"
+	// HealthyCondition is True when the applied objects report to be healthy
+	HealthyCondition = "Healthy"
+	// DriftedCondition is True when the live objects differ from the applied revision
+	DriftedCondition = "Drifted"
+	// SuspendedCondition is True while the reconciliation of the Application is suspended
+	SuspendedCondition = "Suspended"
+	// StalledCondition is True when the sync cannot make progress without a change to the Application or repository
+	StalledCondition = "Stalled"
+)
+
+// Condition reasons reported in the status of an Application
+const (
+	SyncSucceededReason      = "SyncSucceeded"
+	ProgressingReason        = "Progressing"
+	GitOperationFailedReason = "GitOperationFailed"
+	ManifestsNotFoundReason  = "ManifestsNotFound"
+	DecodeFailedReason       = "DecodeFailed"
+	BuildFailedReason        = "BuildFailed"
+	ApplyFailedReason        = "ApplyFailed"
+	PruneFailedReason        = "PruneFailed"
+	SourceChangedReason      = "SourceChanged"
+	HealthNotAssessedReason  = "HealthNotAssessed"
+	HealthyReason            = "Healthy"
+	HealthCheckFailedReason  = "HealthCheckFailed"
+	SuspendedReason          = "Suspended"
+	ResumedReason            = "Resumed"
+	ChangesPendingReason     = "ChangesPending"
+	NoDriftReason            = "NoDrift"
+	DriftDetectedReason      = "DriftDetected"
+	DriftCorrectedReason     = "DriftCorrected"
+	DeletingReason           = "Deleting"
+	DeletionFailedReason     = "DeletionFailed"
+	WaitingForWaveReason     = "WaitingForWave"
+	WaitingForHookReason     = "WaitingForHook"
+	HookFailedReason         = "HookFailed"
+	DependencyNotReadyReason = "DependencyNotReady"
+)
+
+// Reasons of the events emitted for an Application besides the condition reasons
+const (
+	ClonedReason          = "Cloned"
+	RevisionFetchedReason = "RevisionFetched"
+	CreatedReason         = "Created"
+	ConfiguredReason      = "Configured"
+	PrunedReason          = "Pruned"
+	DeletedReason         = "Deleted"
+	OrphanedReason        = "Orphaned"
+	HookStartedReason     = "HookStarted"
+	HookSucceededReason   = "HookSucceeded"
+)
+
+// Results of applying a single object
+const (
+	ResourceCreated    = "Created"
+	ResourceConfigured = "Configured"
+	ResourceUnchanged  = "Unchanged"
+	ResourceFailed     = "Failed"
+)
+
+// Health of a single applied object
+const (
+	HealthHealthy     = "Healthy"
+	HealthProgressing = "Progressing"
+	HealthDegraded    = "Degraded"
+	HealthUnknown     = "Unknown"
+)
+
+// Deletion policies of an Application
+const (
+	DeletionPolicyDelete = "Delete"
+	DeletionPolicyOrphan = "Orphan"
+)
+
+// Sync policies of an Application
+const (
+	SyncPolicyAuto   = "auto"
+	SyncPolicyManual = "manual"
+)
+
+// Phases of a sync hooks run in
+const (
+	HookPreSync  = "PreSync"
+	HookPostSync = "PostSync"
+	HookSyncFail = "SyncFail"
+)
+
+// States of a hook run
+const (
+	HookPending   = "Pending"
+	HookRunning   = "Running"
+	HookSucceeded = "Succeeded"
+	HookFailed    = "Failed"
+)
+
+// Actions a sync would take on a single object
+const (
+	ChangeCreate = "Create"
+	ChangeUpdate = "Update"
+	ChangePrune  = "Prune"
+)
+
+// ResourceChange is a change a pending sync would make to a single object
+type ResourceChange struct {
+	ResourceReference `json:",inline"`
+
+	// Action the sync would take: Create, Update or Prune
+	Action string `json:"action"`
+	// Fields lists the paths of the fields that would change
+	// +optional
+	Fields []string `json:"fields,omitempty"`
+}
+
+// ResourceStatus is the outcome of applying a single object at the last sync
+type ResourceStatus struct {
+	ResourceReference `json:",inline"`
+
+	// Result of applying the object: Created, Configured, Unchanged or Failed
+	Result string `json:"result"`
+	// Message with details about a failure
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Health of the object: Healthy, Progressing, Degraded or Unknown
+	// +optional
+	Health string `json:"health,omitempty"`
+	// HealthMessage explains why the object is not healthy
+	// +optional
+	HealthMessage string `json:"healthMessage,omitempty"`
+}
+
+// HookStatus is the state of a hook run for a revision
+type HookStatus struct {
+	ResourceReference `json:",inline"`
+
+	// Phase of the sync the hook runs in: PreSync, PostSync or SyncFail
+	Phase string `json:"phase"`
+	// Revision the hook runs for
+	Revision string `json:"revision"`
+	// State of the hook: Pending, Running, Succeeded or Failed
+	State string `json:"state"`
+	// Message with details about the state
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // ApplicationStatus defines the observed state of Application
 type ApplicationStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Conditions describing the state of the Application: Ready, Synced, Healthy and Stalled
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// ObservedGeneration is the generation of the Application spec that was last reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastAppliedRevision is the commit SHA that was last synced successfully
+	// +optional
+	LastAppliedRevision string `json:"lastAppliedRevision,omitempty"`
+	// LastAttemptedRevision is the commit SHA of the last sync attempt
+	// +optional
+	LastAttemptedRevision string `json:"lastAttemptedRevision,omitempty"`
+	// Repository the last attempted revision was checked out from
+	// +optional
+	Repository string `json:"repository,omitempty"`
+	// Ref the last attempted revision was checked out from
+	// +optional
+	Ref string `json:"ref,omitempty"`
+	// LastHandledReconcileAt is the value of the reconcile-requested-at annotation handled by the last sync
+	// +optional
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
+	// Failures counts the consecutive failed syncs, used to back off retrying
+	// +optional
+	Failures int `json:"failures,omitempty"`
+	// LastFetchTime is when the Repository was last fetched, it is only fetched again once the interval passed unless
+	// a sync is requested or the Application changed
+	// +optional
+	LastFetchTime *metav1.Time `json:"lastFetchTime,omitempty"`
+	// LastSyncTime is the time of the last successful sync
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+	// LastChangeTime is the time a sync last created or updated objects, the health timeout counts from it
+	// +optional
+	LastChangeTime *metav1.Time `json:"lastChangeTime,omitempty"`
+	// Helm records the release rendered from the chart of the Application
+	// +optional
+	Helm *HelmReleaseStatus `json:"helm,omitempty"`
+	// Resources lists the objects of the last sync attempt with their result
+	// +optional
+	Resources []ResourceStatus `json:"resources,omitempty"`
+	// PendingRevision is the revision waiting for approval with the manual sync policy
+	// +optional
+	PendingRevision string `json:"pendingRevision,omitempty"`
+	// PendingChanges lists what syncing the PendingRevision would change, found with a server-side dry-run
+	// +optional
+	PendingChanges []ResourceChange `json:"pendingChanges,omitempty"`
+	// Drift lists the objects that differ from the applied revision, found with a server-side dry-run
+	// +optional
+	Drift []ResourceChange `json:"drift,omitempty"`
+	// Inventory of the objects applied by the Application, used to prune objects removed from the Repository
+	// +optional
+	Inventory []ResourceReference `json:"inventory,omitempty"`
+	// Hooks lists the hooks of the last attempted revision with their state
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Revision",type=string,JSONPath=`.status.lastAppliedRevision`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Healthy",type=string,JSONPath=`.status.conditions[?(@.type=="Healthy")].status`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
-// Application is the Schema for the applications API
+// Application is the Schema for the applications API. The controller applies the manifests of the Repository with its
+// own, cluster-wide permissions, so creating an Application is as powerful as being able to create any object in the
+// cluster, unless the controller runs with --restrict-namespace
 type Application struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -18,27 +18,31 @@ package controllers
 
 import (
 	"context"
-	"github.com/banzaicloud/k8s-objectmatcher/patch"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
+	"fmt"
 	"github.com/go-logr/logr"
-	"io/fs"
-	"io/ioutil"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sync"
 	"time"
 
-	//"k8s.io/client-go/restmapper"
-	"os"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	gitopsv1 "github.com/uvegla/potato/api/v1"
 )
@@ -47,362 +51,572 @@ import (
 type ApplicationReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// FieldManager is the name used to track the ownership of applied fields, defaults to DefaultFieldManager
+	FieldManager string
+	// ForceConflicts takes over the ownership of fields that are managed by someone else when applying
+	ForceConflicts bool
+	// LegacyFieldManagers are the field managers the controller updated objects with before using server-side apply,
+	// their fields are handed over to FieldManager the first time an object is applied
+	LegacyFieldManagers []string
+	// RestrictNamespace only lets Applications apply namespaced objects to their own namespace, refusing cluster-scoped
+	// objects and objects in other namespaces
+	RestrictNamespace bool
+
+	// Recorder emits the events of the sync lifecycle, defaults to a recorder of the Manager
+	Recorder record.EventRecorder
+
+	// DefaultInterval is how often Applications without an interval of their own are synced, defaults to
+	// DefaultInterval
+	DefaultInterval time.Duration
+
+	// Cache stores the repositories of the Applications, defaults to a cache in DefaultCacheDir
+	Cache *RepositoryCache
+
+	// Events triggers syncs outside of the interval, e.g. from the webhook Receiver
+	Events <-chan event.GenericEvent
+
+	// Discovery describes the cluster to Helm charts, defaults to a client for the API server of the Manager
+	Discovery discovery.DiscoveryInterface
+
+	// triggered holds the Applications whose repository has to be fetched on the next sync, as a webhook reported a push
+	triggered sync.Map
 }
 
-const NAMESPACE = "default"
+// DefaultFieldManager is the field manager used for server-side apply if none is configured
+const DefaultFieldManager = "potato"
+
+// ReconcileRequestAnnotation triggers a sync outside of the interval when its value changes, e.g. set to the current time
+const ReconcileRequestAnnotation = "gitops.potato.io/reconcile-requested-at"
 
 //+kubebuilder:rbac:groups=gitops.potato.io,resources=applications,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=gitops.potato.io,resources=applications/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=gitops.potato.io,resources=applications/finalizers,verbs=update
-//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get
-// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups="",resources=services/status,verbs=get;update;patch
-
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the Application object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.11.0/pkg/reconcile
+//+kubebuilder:rbac:groups=*,resources=*,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile syncs an Application with its repository. Deleted Applications get their objects torn down according to
+// their deletion policy, suspended ones and ones waiting for their dependencies are left alone. Otherwise the revision
+// the ref points to is checked out, its manifests are rendered and applied, objects removed from the repository are
+// pruned and the health of the applied objects is assessed, all of which is recorded in the status of the Application.
+// It is requeued at the sync interval, or sooner to retry failures or to continue a sync that is waiting.
 func (r *ApplicationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	// S E T U P
 	logger := log.FromContext(ctx)
 	logger.Info("Reconciling Application: " + req.Name + " in namespace: " + req.Namespace)
 
-	repositoryPath := "/tmp/" + req.NamespacedName.String()
-
 	// G E T   A P P L I C A T I O N   R E S O U R C E
 
 	application := &gitopsv1.Application{}
 	err := r.Get(ctx, req.NamespacedName, application)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			// The objects of the Application were torn down by its finalizer, the worktree is left to the garbage
+			// collection of the repository cache, in case the Application is only missing from the cache for a moment
 			logger.Info("Application resource not found, object was deleted.")
-			logger.Info("Cleaning up local repository: " + repositoryPath)
-
-			// Clean up local repository if exists
-			if err := os.RemoveAll(repositoryPath); err != nil {
-				logger.Error(err, "Failed to clean up local repository: "+repositoryPath)
-			}
-
 			return ctrl.Result{}, nil
 		}
 		logger.Error(err, "Failed to get Application resource...")
 		return ctrl.Result{}, err
 	}
 
-	logger.Info("Repository: " + application.Spec.Repository + ", Ref: " + application.Spec.Ref)
+	// F I N A L I Z E
 
-	// S E T U P   G I T   R E P O S I T O R Y
+	if !application.DeletionTimestamp.IsZero() {
+		logger.Info("Application is being deleted, tearing down its objects...")
+		return r.finalize(ctx, application, logger)
+	}
 
-	if _, err := os.Stat(repositoryPath); err != nil {
-		if os.IsNotExist(err) {
-			logger.Info("Cloning into: " + repositoryPath)
+	if err := r.ensureFinalizer(ctx, application); err != nil {
+		logger.Error(err, "Failed to add finalizer to Application")
+		return ctrl.Result{}, err
+	}
 
-			_, err := git.PlainClone("/tmp/"+req.NamespacedName.String(), false, &git.CloneOptions{
-				URL:           application.Spec.Repository,
-				ReferenceName: plumbing.ReferenceName("refs/heads/" + application.Spec.Ref),
-				//Depth:         1,
-				Progress: os.Stdout,
-			})
+	logger.Info("Repository: " + application.Spec.Repository + ", Ref: " + application.Spec.Ref.String())
 
-			//head, _ := repository.Head()
-			//resourceVersion = head.Hash().String()
+	original := application.DeepCopy()
+	markSuspended(application, application.Spec.Suspend)
 
-			if err != nil {
-				logger.Error(err, "Failed to clone git repository...")
-				return ctrl.Result{}, err
-			}
-		} else {
-			logger.Error(err, "Failed to stat repository...")
+	// S U S P E N D
+
+	if application.Spec.Suspend {
+		logger.Info("Reconciliation is suspended, skipping sync")
+
+		// Resuming changes the spec, which triggers a reconciliation, so there is no need to requeue
+		application.Status.ObservedGeneration = application.Generation
+		if err := r.Status().Patch(ctx, application, client.MergeFrom(original)); err != nil {
+			logger.Error(err, "Failed to update Application status")
 			return ctrl.Result{}, err
 		}
-	} else {
-		logger.Info("Repository exists at: " + repositoryPath + ", pulling changes...")
 
-		repository, err := git.PlainOpen(repositoryPath)
+		return ctrl.Result{}, nil
+	}
 
-		if err != nil {
-			logger.Error(err, "Failed to open repository...")
-		}
+	markProgressing(application)
+
+	requestedAt, requested := application.Annotations[ReconcileRequestAnnotation]
+	if requested && requestedAt != application.Status.LastHandledReconcileAt {
+		logger.Info("Sync requested at: " + requestedAt)
+	}
 
-		workTree, _ := repository.Worktree()
+	// C H E C K   D E P E N D E N C I E S
 
-		if err := workTree.Pull(&git.PullOptions{RemoteName: "origin"}); err != nil {
-			if err == git.NoErrAlreadyUpToDate {
-				logger.Info("Repository is already up to date")
-			}
-		}
+	ready, err := r.checkDependencies(ctx, application, logger)
+	if err == nil && ready {
+		err = r.syncApplication(ctx, application, logger)
 	}
 
-	// D I S C O V E R   M A N I F E S T S
+	// U P D A T E   S T A T U S
 
-	manifestsDir := repositoryPath + "/kubernetes"
-	files, err := ioutil.ReadDir(manifestsDir)
+	application.Status.ObservedGeneration = application.Generation
+	if requested && ready {
+		application.Status.LastHandledReconcileAt = requestedAt
+	}
 	if err != nil {
-		logger.Error(err, "Failed to read manifests in: "+manifestsDir)
-		return ctrl.Result{}, err
+		application.Status.Failures++
+	} else {
+		application.Status.Failures = 0
 	}
 
-	for _, file := range files {
-		logger.Info("Found manifest: " + file.Name())
+	if err := r.Status().Patch(ctx, application, client.MergeFrom(original)); err != nil {
+		logger.Error(err, "Failed to update Application status")
+		return ctrl.Result{}, err
 	}
 
-	// D E S E R I A L I Z E   A N D   R E C O N C I L E   M A N I F E S T S
-	for _, file := range files {
-		object, groupVersionKind, _ := r.decodeManifest(manifestsDir, file, logger)
+	// Requeue for periodically checking on the state of the repository, or retrying with a backoff after a failure
+	requeueAfter := r.requeueAfter(application, err != nil, meta.IsStatusConditionTrue(application.Status.Conditions, gitopsv1.StalledCondition))
+	logger.Info("Next sync in: " + requeueAfter.Round(time.Second).String())
 
-		if err != nil {
-			logger.Error(err, "Failed to decode manifest: "+file.Name()+", bailing out")
-			return ctrl.Result{}, nil
-		}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
 
-		err := r.reconcileManifest(ctx, application, groupVersionKind, object, logger)
+// syncApplication brings the repository of the Application up to date and applies its manifests to the cluster,
+// recording the outcome in the status of the Application.
+func (r *ApplicationReconciler) syncApplication(ctx context.Context, application *gitopsv1.Application, logger logr.Logger) error {
+	// S E T U P   G I T   R E P O S I T O R Y
 
-		if err != nil {
-			switch err.(type) {
-			case *FailedToMapDecodedManifest:
-				logger.Error(err, "Application contains a manifest that cannot be mapped, bailing out...")
-				return ctrl.Result{}, nil
-			case *FailedToReconcileManifest:
-				logger.Error(err, "Failed to reconcile manifest: "+file.Name())
-				return ctrl.Result{}, err
-			}
-		}
+	revision, repositoryPath, err := r.syncRepository(ctx, application, logger)
+	if err != nil {
+		r.Recorder.Eventf(application, corev1.EventTypeWarning, gitopsv1.GitOperationFailedReason, "Failed to sync %s at %s: %s", application.Spec.Repository, application.Spec.Ref.String(), err)
+		markFailed(application, gitopsv1.GitOperationFailedReason, err, false)
+		return err
+	}
+
+	logger.Info("Checked out revision: " + revision)
+	if application.Status.LastAttemptedRevision != "" && application.Status.LastAttemptedRevision != revision {
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.RevisionFetchedReason, "Fetched new revision %s of %s", revision, application.Spec.Ref.String())
 	}
+	application.Status.LastAttemptedRevision = revision
 
-	// C L E A N   U P
-	//var children client.ObjectList
-	//if err := r.List(ctx, children, client.InNamespace(NAMESPACE), ???); err != nil {
-	//	logger.Error(err, "unable to owned object")
-	//	return ctrl.Result{}, err
-	//}
+	if application.Status.Repository != "" && (application.Status.Repository != application.Spec.Repository || application.Status.Ref != application.Spec.Ref.String()) {
+		message := fmt.Sprintf("Switched from %s@%s to %s@%s at revision %s", application.Status.Repository, application.Status.Ref, application.Spec.Repository, application.Spec.Ref.String(), revision)
+		logger.Info(message)
+		r.Recorder.Event(application, corev1.EventTypeNormal, gitopsv1.SourceChangedReason, message)
+	}
 
-	// Requeue for periodically checking on the state of the repository
-	return ctrl.Result{Requeue: true, RequeueAfter: time.Duration(10) * time.Second}, nil
-}
+	application.Status.Repository = application.Spec.Repository
+	application.Status.Ref = application.Spec.Ref.String()
 
-func (r *ApplicationReconciler) decodeManifest(manifestsDir string, file fs.FileInfo, logger logr.Logger) (runtime.Object, *schema.GroupVersionKind, error) {
-	manifest := manifestsDir + "/" + file.Name()
+	// R E N D E R   A N D   D E S E R I A L I Z E   M A N I F E S T S
+
+	objects, err := r.renderManifests(ctx, application, repositoryPath, logger)
+	if err == nil {
+		err = orderManifests(objects)
+	}
 
-	stream, err := os.ReadFile(manifest)
+	var hooks map[string][]*unstructured.Unstructured
+	if err == nil {
+		objects, hooks, err = splitHooks(objects)
+	}
 	if err != nil {
-		logger.Error(err, "Failed to read manifest file: "+manifest)
-		return nil, nil, err
+		reason, stalled := gitopsv1.DecodeFailedReason, true
+		if renderErr, ok := err.(*FailedToRenderManifests); ok {
+			reason, stalled = renderErr.Reason, renderErr.Stalled
+		}
+
+		r.Recorder.Eventf(application, corev1.EventTypeWarning, reason, "%s at revision %s", err, revision)
+		markFailed(application, reason, err, stalled)
+		return err
 	}
 
-	object, groupVersionKind, err := scheme.Codecs.UniversalDeserializer().Decode(stream, nil, nil)
+	resetHooks(application, revision)
 
-	logger.Info("Parsed a " + groupVersionKind.String() + " from " + manifest)
+	// D R Y   R U N
 
-	return object, groupVersionKind, err
-}
+	if needsApproval(application, revision) {
+		return r.planSync(ctx, application, revision, objects, logger)
+	}
 
-type FailedToMapDecodedManifest struct{}
+	application.Status.PendingRevision = ""
+	application.Status.PendingChanges = nil
 
-func (e *FailedToMapDecodedManifest) Error() string {
-	return "Failed to map decoded manifest!"
-}
+	// D E T E C T   D R I F T
 
-type FailedToReconcileManifest struct{}
+	var drift []gitopsv1.ResourceChange
 
-func (e *FailedToReconcileManifest) Error() string {
-	return "Failed to reconcile manifest!"
-}
+	if inSync(application, revision) {
+		var live []*unstructured.Unstructured
+		drift, live, err = r.detectDrift(ctx, application, objects, logger)
+		if err != nil {
+			markFailed(application, gitopsv1.ApplyFailedReason, err, false)
+			return err
+		}
+
+		if len(drift) == 0 || !selfHeal(application) {
+			r.markDrift(application, drift, false)
+
+			// Nothing to apply, the health check goes by the live objects
+			var resources []gitopsv1.ResourceStatus
+			for _, object := range live {
+				resource := gitopsv1.ResourceStatus{ResourceReference: resourceReferenceOf(object), Result: gitopsv1.ResourceUnchanged}
+				resource.Health, resource.HealthMessage = assessHealth(object)
+				resources = append(resources, resource)
+			}
+			application.Status.Resources = resources
 
-func (r *ApplicationReconciler) reconcileManifest(ctx context.Context, owner *gitopsv1.Application, groupVersionKind *schema.GroupVersionKind, obj runtime.Object, logger logr.Logger) error {
-	if groupVersionKind.GroupVersion().String() == "apps/v1" && groupVersionKind.Kind == "Deployment" {
-		deployment := obj.(*appsv1.Deployment)
-		logger.Info("Object is a Deployment: " + deployment.Name)
-		return r.reconcileAppsV1Deployment(ctx, owner, deployment)
-	} else if groupVersionKind.GroupVersion().String() == "v1" && groupVersionKind.Kind == "Service" {
-		service := obj.(*corev1.Service)
-		logger.Info("Object is a Service: " + service.Name)
+			markSynced(application, revision)
+			r.checkHealth(application, revision, resources, false, logger)
+			return r.runPostSyncHooks(ctx, application, revision, hooks, logger)
+		}
 
-		return r.reconcileCoreV1Service(ctx, owner, service)
+		logger.Info("Reverting drift: " + driftMessage(drift))
 	}
 
-	return &FailedToMapDecodedManifest{}
-}
+	// P R E   S Y N C   H O O K S
+
+	// Hooks run for every sync of a revision, but not for reverting drift
+	if len(drift) == 0 {
+		waiting, err := r.runHooks(ctx, application, revision, gitopsv1.HookPreSync, hooks[gitopsv1.HookPreSync], logger)
+		if err != nil {
+			// A failed hook blocks the revision until a new one is fetched or a sync is requested
+			reason, stalled := gitopsv1.ApplyFailedReason, false
+			if _, ok := err.(*FailedToRunHook); ok {
+				reason, stalled = gitopsv1.HookFailedReason, true
+			}
 
-func (r *ApplicationReconciler) reconcileAppsV1Deployment(ctx context.Context, owner *gitopsv1.Application, deployment *appsv1.Deployment) error {
-	namespacedName := types.NamespacedName{
-		Name:      deployment.Name,
-		Namespace: NAMESPACE,
+			markFailed(application, reason, err, stalled)
+			r.runSyncFailHooks(ctx, application, revision, hooks[gitopsv1.HookSyncFail], logger)
+			return err
+		}
+
+		if waiting != "" {
+			logger.Info("Waiting for " + waiting)
+			markWaiting(application, gitopsv1.WaitingForHookReason, "Waiting for "+waiting)
+			return nil
+		}
 	}
 
-	logger := log.Log.WithValues("deployment", namespacedName)
+	// R E C O N C I L E   M A N I F E S T S
+
+	var inventory []gitopsv1.ResourceReference
+	var resources []gitopsv1.ResourceStatus
+	changed := false
+
+	// The objects are ordered by sync wave, the wave starting at waveStart has to be healthy before moving on
+	wave, waveStart := 0, 0
+
+	for i, object := range objects {
+		// Validated when ordering the manifests
+		objectWave, _ := syncWave(object)
+
+		if i > 0 && objectWave != wave {
+			if health, message := aggregateHealth(resources[waveStart:]); health != gitopsv1.HealthHealthy {
+				// Like a failed sync, keep what is not applied yet in the inventory and do not prune
+				application.Status.Resources = resources
+				application.Status.Inventory = append(inventory, staleResources(application.Status.Inventory, inventory)...)
+				r.checkHealth(application, revision, resources, changed, logger)
+
+				// A wave that will not become healthy by waiting fails the sync, which is retried with a backoff
+				if waveFailed(application, health) {
+					err := fmt.Errorf("sync wave %d is not healthy: %s", wave, message)
+					logger.Error(err, "Sync wave failed")
+					r.Recorder.Eventf(application, corev1.EventTypeWarning, gitopsv1.HealthCheckFailedReason, "Sync wave %d failed at revision %s: %s", wave, revision, message)
+					markFailed(application, gitopsv1.HealthCheckFailedReason, err, false)
+					r.runSyncFailHooks(ctx, application, revision, hooks[gitopsv1.HookSyncFail], logger)
+					return err
+				}
+
+				logger.Info(fmt.Sprintf("Waiting for sync wave %d to become healthy", wave))
+				markWaiting(application, gitopsv1.WaitingForWaveReason, fmt.Sprintf("Waiting for sync wave %d to become healthy: %s", wave, message))
+				return nil
+			}
 
-	logger.Info("Reconciling deployment...")
+			waveStart = len(resources)
+		}
+		wave = objectWave
 
-	existing := &appsv1.Deployment{}
-	err := r.Get(ctx, namespacedName, existing)
+		result, err := r.reconcileManifest(ctx, application, object, len(drift) > 0, logger)
 
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Deployment not found, creating...")
+		resources = append(resources, gitopsv1.ResourceStatus{ResourceReference: resourceReferenceOf(object), Result: result})
 
-		deployment.SetNamespace(NAMESPACE)
+		if err != nil {
+			switch err.(type) {
+			case *FailedToMapDecodedManifest:
+				logger.Error(err, "Application contains a manifest of a kind unknown to the cluster: "+object.GroupVersionKind().String())
+			case *FailedToReconcileManifest:
+				logger.Error(err, "Failed to reconcile manifest: "+resourceReferenceString(resourceReferenceOf(object)))
+			}
+
+			resources[len(resources)-1].Message = err.Error()
+			r.Recorder.Eventf(application, corev1.EventTypeWarning, gitopsv1.ApplyFailedReason, "Failed to apply %s at revision %s: %s", resourceReferenceString(resourceReferenceOf(object)), revision, err)
 
-		if err := controllerutil.SetControllerReference(owner, deployment, r.Scheme); err != nil {
-			logger.Error(err, "Failed to set owner reference on deployment!")
+			// Do not forget about anything applied so far, as the sync did not get to the end
+			application.Status.Resources = resources
+			application.Status.Inventory = append(inventory, staleResources(application.Status.Inventory, inventory)...)
+			markFailed(application, gitopsv1.ApplyFailedReason, err, false)
+			r.runSyncFailHooks(ctx, application, revision, hooks[gitopsv1.HookSyncFail], logger)
 			return err
 		}
 
-		if err := patch.DefaultAnnotator.SetLastAppliedAnnotation(deployment); err != nil {
-			logger.Error(err, "Failed to set last applied annotation!")
+		// The applied object carries the status the cluster reported for it
+		resources[len(resources)-1].Health, resources[len(resources)-1].HealthMessage = assessHealth(object)
+		changed = changed || result != gitopsv1.ResourceUnchanged
+
+		switch result {
+		case gitopsv1.ResourceCreated:
+			r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.CreatedReason, "Created %s at revision %s", resourceReferenceString(resourceReferenceOf(object)), revision)
+		case gitopsv1.ResourceConfigured:
+			r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.ConfiguredReason, "Configured %s at revision %s", resourceReferenceString(resourceReferenceOf(object)), revision)
 		}
 
-		err := r.Create(ctx, deployment)
+		inventory = append(inventory, resourceReferenceOf(object))
+	}
+	application.Status.Resources = resources
+
+	// P R U N E
 
-		if err != nil {
-			logger.Error(err, "Failed to create deployment!")
-			return &FailedToReconcileManifest{}
-		}
-	} else if err == nil {
-		logger.Info("Deployment found...")
+	stale := staleResources(application.Status.Inventory, inventory)
 
-		patchResult, err := patch.DefaultPatchMaker.Calculate(existing, deployment)
+	if application.Spec.Prune && len(stale) > 0 {
+		remaining, err := r.pruneResources(ctx, application, revision, stale, logger)
+
+		// Keep what could not be pruned in the inventory, so it is retried on the next sync
+		application.Status.Inventory = append(inventory, remaining...)
 
 		if err != nil {
+			logger.Error(err, "Failed to prune objects removed from the repository")
+			r.Recorder.Eventf(application, corev1.EventTypeWarning, gitopsv1.PruneFailedReason, "Failed to prune objects removed at revision %s: %s", revision, err)
+			markFailed(application, gitopsv1.PruneFailedReason, err, false)
+			r.runSyncFailHooks(ctx, application, revision, hooks[gitopsv1.HookSyncFail], logger)
 			return err
 		}
+	} else {
+		application.Status.Inventory = inventory
+	}
 
-		if !patchResult.IsEmpty() {
-			logger.Info("Deployment differs, updating to desired state...")
+	markSynced(application, revision)
+	r.markDrift(application, drift, len(drift) > 0)
 
-			existing.Spec = deployment.Spec
+	// H E A L T H   C H E C K
 
-			// TODO Shameful copy pasting
-			existing.SetNamespace(NAMESPACE)
+	r.checkHealth(application, revision, resources, changed, logger)
 
-			if err := controllerutil.SetControllerReference(owner, existing, r.Scheme); err != nil {
-				logger.Error(err, "Failed to set owner reference on deployment!")
-				return err
-			}
+	// P O S T   S Y N C   H O O K S
 
-			if err := patch.DefaultAnnotator.SetLastAppliedAnnotation(deployment); err != nil {
-				logger.Error(err, "Failed to set last applied annotation!")
-			}
+	return r.runPostSyncHooks(ctx, application, revision, hooks, logger)
+}
 
-			if err := r.Update(ctx, existing); err != nil {
-				logger.Error(err, "Failed to update deployment!")
-				return err
-			}
-		} else {
-			logger.Info("Deployment matches desired state, yay!")
-		}
-	}
+type FailedToMapDecodedManifest struct {
+	Err error
+}
 
-	return err
+func (e *FailedToMapDecodedManifest) Error() string {
+	return "Failed to map decoded manifest: " + e.Err.Error()
 }
 
-func (r *ApplicationReconciler) reconcileCoreV1Service(ctx context.Context, owner *gitopsv1.Application, service *corev1.Service) error {
-	namespacedName := types.NamespacedName{
-		Name:      service.Name,
-		Namespace: NAMESPACE,
+func (e *FailedToMapDecodedManifest) Unwrap() error {
+	return e.Err
+}
+
+type FailedToReconcileManifest struct {
+	Err error
+}
+
+func (e *FailedToReconcileManifest) Error() string {
+	return "Failed to reconcile manifest: " + e.Err.Error()
+}
+
+func (e *FailedToReconcileManifest) Unwrap() error {
+	return e.Err
+}
+
+// reconcileManifest applies a single decoded manifest of any kind the API server knows about with server-side apply,
+// so only the fields present in the manifest are owned by the controller and fields set by others are left alone. The
+// RESTMapper of the cluster is used to figure out whether the kind is namespaced, so custom resources are handled the
+// same way as built-in ones. With force the fields of the manifest are taken over from other field managers, e.g. to
+// revert drift.
+func (r *ApplicationReconciler) reconcileManifest(ctx context.Context, owner *gitopsv1.Application, object *unstructured.Unstructured, force bool, logger logr.Logger) (string, error) {
+	groupVersionKind := object.GroupVersionKind()
+
+	if err := r.prepareManifest(ctx, owner, object, owner.Spec.CreateNamespace, logger); err != nil {
+		return gitopsv1.ResourceFailed, err
 	}
 
-	logger := log.Log.WithValues("service", namespacedName)
+	logger = logger.WithValues("kind", groupVersionKind.Kind, "object", client.ObjectKeyFromObject(object))
 
-	logger.Info("Reconciling service...")
+	logger.Info("Reconciling object...")
 
-	existing := &corev1.Service{}
-	err := r.Get(ctx, namespacedName, existing)
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(groupVersionKind)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(object), existing); err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get object!")
+		return gitopsv1.ResourceFailed, &FailedToReconcileManifest{Err: err}
+	}
 
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Service not found, creating...")
+	if err := r.upgradeManagedFields(ctx, existing, logger); err != nil {
+		logger.Error(err, "Failed to upgrade managed fields!")
+		return gitopsv1.ResourceFailed, &FailedToReconcileManifest{Err: err}
+	}
 
-		service.SetNamespace(NAMESPACE)
+	if err := r.Patch(ctx, object, client.Apply, r.applyOptions(force)...); err != nil {
+		logger.Error(err, "Failed to apply object!")
+		return gitopsv1.ResourceFailed, &FailedToReconcileManifest{Err: err}
+	}
 
-		if err := controllerutil.SetControllerReference(owner, service, r.Scheme); err != nil {
-			logger.Error(err, "Failed to set owner reference on service!")
-			return err
+	if existing.GetResourceVersion() == "" {
+		logger.Info("Object created")
+		return gitopsv1.ResourceCreated, nil
+	} else if existing.GetResourceVersion() != object.GetResourceVersion() {
+		logger.Info("Object differed, updated to desired state")
+		return gitopsv1.ResourceConfigured, nil
+	}
+
+	logger.Info("Object matches desired state, yay!")
+	return gitopsv1.ResourceUnchanged, nil
+}
+
+// collectGarbage periodically removes the entries of the repository cache that are no longer needed by any Application.
+func (r *ApplicationReconciler) collectGarbage(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("cache")
+
+	ticker := time.NewTicker(DefaultGarbageCollectionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
 		}
 
-		if err := patch.DefaultAnnotator.SetLastAppliedAnnotation(service); err != nil {
-			logger.Error(err, "Failed to set last applied annotation!")
+		applications := &gitopsv1.ApplicationList{}
+		if err := r.List(ctx, applications); err != nil {
+			logger.Error(err, "Failed to list Applications for garbage collection")
+			continue
 		}
 
-		err := r.Create(ctx, service)
+		r.Cache.CollectGarbage(applications.Items, logger)
+	}
+}
 
-		if err != nil {
-			logger.Error(err, "Failed to create service!")
-			return &FailedToReconcileManifest{}
-		}
-	} else if err == nil {
-		logger.Info("Service found...")
+// prepareManifest sets the namespace and the owner reference of a decoded manifest before applying it. The RESTMapper of
+// the cluster is used to figure out whether the kind is namespaced. With createNamespace the namespace of the object is
+// created if it does not exist yet.
+func (r *ApplicationReconciler) prepareManifest(ctx context.Context, owner *gitopsv1.Application, object *unstructured.Unstructured, createNamespace bool, logger logr.Logger) error {
+	groupVersionKind := object.GroupVersionKind()
 
-		patchResult, err := patch.DefaultPatchMaker.Calculate(existing, service)
+	mapping, err := r.RESTMapper().RESTMapping(groupVersionKind.GroupKind(), groupVersionKind.Version)
+	if err != nil {
+		logger.Error(err, "Failed to find a REST mapping for: "+groupVersionKind.String())
+		return &FailedToMapDecodedManifest{Err: err}
+	}
 
-		if err != nil {
-			return err
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		if r.RestrictNamespace {
+			return &FailedToReconcileManifest{Err: fmt.Errorf("%s %s is cluster-scoped, Applications may only apply objects to their own namespace", groupVersionKind.Kind, object.GetName())}
 		}
 
-		if !patchResult.IsEmpty() {
-			logger.Info("Service differs, updating to desired state...")
-
-			existing.Spec.Selector = service.Spec.Selector
-			existing.Spec.Ports = service.Spec.Ports
+		// Cluster-scoped objects cannot be owned by a namespaced Application and have no namespace
+		object.SetNamespace("")
+		return nil
+	}
 
-			// TODO Shameful copy pasting
-			existing.SetNamespace(NAMESPACE)
+	object.SetNamespace(targetNamespace(owner, object))
 
-			if err := controllerutil.SetControllerReference(owner, existing, r.Scheme); err != nil {
-				logger.Error(err, "Failed to set owner reference on service!")
-				return err
-			}
+	if r.RestrictNamespace && object.GetNamespace() != owner.Namespace {
+		return &FailedToReconcileManifest{Err: fmt.Errorf("%s %s is in namespace %s, Applications may only apply objects to their own namespace %s", groupVersionKind.Kind, object.GetName(), object.GetNamespace(), owner.Namespace)}
+	}
 
-			if err := patch.DefaultAnnotator.SetLastAppliedAnnotation(service); err != nil {
-				logger.Error(err, "Failed to set last applied annotation!")
-			}
+	if createNamespace {
+		if err := r.ensureNamespace(ctx, object.GetNamespace(), logger); err != nil {
+			return &FailedToReconcileManifest{Err: err}
+		}
+	}
 
-			if err := r.Update(ctx, existing); err != nil {
-				logger.Error(err, "Failed to update service!")
-				return err
-			}
-		} else {
-			logger.Info("Service matches desired state, yay!")
+	// Owner references cannot point across namespaces, objects in other namespaces are not garbage collected
+	if object.GetNamespace() == owner.Namespace {
+		if err := controllerutil.SetControllerReference(owner, object, r.Scheme); err != nil {
+			logger.Error(err, "Failed to set owner reference on: "+object.GetName())
+			return &FailedToReconcileManifest{Err: err}
 		}
 	}
 
 	return nil
 }
 
-//func (r *ApplicationReconciler) createOrUpdateResource(ctx context.Context, obj client.Object, resourceVersion string, logger logr.Logger) error {
-//	obj.SetNamespace("default")
-//
-//	err := r.Create(ctx, obj)
-//
-//	if err != nil {
-//		if errors.IsAlreadyExists(err) {
-//			logger.Info("Resource " + obj.GetGenerateName() + " exists, updating...")
-//
-//			//if obj.GetResourceVersion() != resourceVersion {
-//			//	obj.SetResourceVersion(resourceVersion)
-//			//	return r.Update(ctx, obj)
-//			//}
-//
-//			logger.Info("Resource version is: " + resourceVersion)
-//			return nil
-//		}
-//
-//		logger.Error(err, "Failed to create resource: "+obj.GetGenerateName())
-//		return err
-//	}
-//
-//	logger.Info("Created resource: " + obj.GetGenerateName())
-//	return nil
-//}
-
-// SetupWithManager sets up the controller with the Manager.
+// applyOptions returns the options of server-side apply patches, forcing the ownership of conflicting fields if asked
+// to or if the controller is configured to.
+func (r *ApplicationReconciler) applyOptions(force bool) []client.PatchOption {
+	applyOptions := []client.PatchOption{client.FieldOwner(r.fieldManager())}
+	if r.ForceConflicts || force {
+		applyOptions = append(applyOptions, client.ForceOwnership)
+	}
+
+	return applyOptions
+}
+
+// fieldManager returns the name the controller uses to claim ownership of fields with server-side apply.
+func (r *ApplicationReconciler) fieldManager() string {
+	if r.FieldManager == "" {
+		return DefaultFieldManager
+	}
+
+	return r.FieldManager
+}
+
+// SetupWithManager sets up the controller with the Manager, along with the garbage collection of its repository cache.
 func (r *ApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&gitopsv1.Application{}).
+	if r.Cache == nil {
+		r.Cache = NewRepositoryCache(DefaultCacheDir, 0)
+	}
+
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("potato")
+	}
+
+	if r.Discovery == nil {
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+		if err != nil {
+			return err
+		}
+		r.Discovery = discoveryClient
+	}
+
+	if err := mgr.Add(manager.RunnableFunc(r.collectGarbage)); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &gitopsv1.Application{}, dependsOnIndex, indexDependencies); err != nil {
+		return err
+	}
+
+	controller := ctrl.NewControllerManagedBy(mgr).
+		// Status updates do not trigger a sync, changes to the spec and the annotations, e.g. ReconcileRequestAnnotation, do
+		For(&gitopsv1.Application{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		// Applications waiting for a dependency are synced once it becomes ready
+		Watches(&gitopsv1.Application{}, handler.EnqueueRequestsFromMapFunc(r.dependentApplications), builder.WithPredicates(dependencyChangedPredicate)).
 		Owns(&appsv1.Deployment{}).
-		Owns(&corev1.Service{}).
-		Complete(r)
+		Owns(&corev1.Service{})
+
+	if r.Events != nil {
+		controller = controller.WatchesRawSource(&source.Channel{Source: r.Events}, handler.Funcs{
+			GenericFunc: func(ctx context.Context, e event.GenericEvent, queue workqueue.RateLimitingInterface) {
+				// The push has to be fetched, even if the interval did not pass yet
+				key := client.ObjectKeyFromObject(e.Object)
+				r.triggered.Store(key, true)
+				queue.Add(reconcile.Request{NamespacedName: key})
+			},
+		})
+	}
+
+	return controller.Complete(r)
 }
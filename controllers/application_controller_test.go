@@ -5,6 +5,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"time"
@@ -45,7 +46,7 @@ var _ = Describe("Application controller", func() {
 				},
 				Spec: gitopsv1.ApplicationSpec{
 					Repository: ApplicationRepository,
-					Ref:        "master",
+					Ref:        &gitopsv1.GitReference{Branch: "master"},
 				},
 			}
 
@@ -79,6 +80,21 @@ var _ = Describe("Application controller", func() {
 				return true
 			}, timeout, interval).Should(BeTrue())
 
+			By("By reporting the synced revision in the status")
+
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, applicationKey, createdApplication)
+
+				if err != nil {
+					return false
+				}
+
+				return meta.IsStatusConditionTrue(createdApplication.Status.Conditions, gitopsv1.ReadyCondition)
+			}, timeout, interval).Should(BeTrue())
+
+			Expect(createdApplication.Status.LastAppliedRevision).ShouldNot(BeEmpty())
+			Expect(createdApplication.Status.ObservedGeneration).Should(Equal(createdApplication.Generation))
+
 			Consistently(func() (int32, error) {
 				err := k8sClient.Get(ctx, deploymentKey, expectedDeployment)
 
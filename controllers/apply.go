@@ -0,0 +1,51 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/csaupgrade"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultLegacyFieldManager is the field manager the controller updated objects with before it used server-side apply,
+// client-go names it after the binary
+const DefaultLegacyFieldManager = "manager"
+
+// upgradeManagedFields hands the fields an existing object has updated by the legacy field managers over to the field
+// manager of server-side apply, once. Otherwise the fields would stay owned by the legacy field managers and changing
+// them in the repository would conflict on every sync. The existing object is updated with the patched one, so its
+// resource version can still be compared to the applied one.
+func (r *ApplicationReconciler) upgradeManagedFields(ctx context.Context, existing *unstructured.Unstructured, logger logr.Logger) error {
+	if len(r.LegacyFieldManagers) == 0 || existing.GetResourceVersion() == "" {
+		return nil
+	}
+
+	patch, err := csaupgrade.UpgradeManagedFieldsPatch(existing, sets.New(r.LegacyFieldManagers...), r.fieldManager())
+	if err != nil || patch == nil {
+		return err
+	}
+
+	logger.Info("Taking over the fields of the legacy field managers")
+
+	return r.Patch(ctx, existing, client.RawPatch(types.JSONPatchType, patch))
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// fakeApply stands in for server-side apply, which the fake client does not support. Apply patches are stored as a
+// create or an update of the whole object, dry-runs return the object without storing it. Other patches are passed on.
+func fakeApply(ctx context.Context, c client.WithWatch, object client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Patch(ctx, object, patch, opts...)
+	}
+
+	options := &client.PatchOptions{}
+	options.ApplyOptions(opts)
+
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(object.GetObjectKind().GroupVersionKind())
+	if err := c.Get(ctx, client.ObjectKeyFromObject(object), live); err != nil {
+		if !errors.IsNotFound(err) || len(options.DryRun) > 0 {
+			return client.IgnoreNotFound(err)
+		}
+
+		return c.Create(ctx, object)
+	}
+
+	object.SetResourceVersion(live.GetResourceVersion())
+	object.SetUID(live.GetUID())
+	object.SetCreationTimestamp(live.GetCreationTimestamp())
+	object.SetManagedFields(live.GetManagedFields())
+
+	if len(options.DryRun) > 0 {
+		return nil
+	}
+
+	return c.Update(ctx, object)
+}
+
+var _ = Describe("Server-side apply", func() {
+	ctx := context.Background()
+
+	var reconciler *ApplicationReconciler
+	var application *gitopsv1.Application
+
+	// What the apply patches were sent with, and the managed fields of the live object at that time
+	var applyOptions []*client.PatchOptions
+	var managedFieldsAtApply [][]metav1.ManagedFieldsEntry
+
+	manifest := func(replicas int64) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{}
+		object.SetAPIVersion("apps/v1")
+		object.SetKind("Deployment")
+		object.SetNamespace("default")
+		object.SetName("cowsay")
+		Expect(unstructured.SetNestedField(object.Object, replicas, "spec", "replicas")).Should(Succeed())
+		return object
+	}
+
+	legacy := func() *appsv1.Deployment {
+		replicas := int32(1)
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cowsay",
+				Namespace: "default",
+				ManagedFields: []metav1.ManagedFieldsEntry{{
+					Manager:    DefaultLegacyFieldManager,
+					Operation:  metav1.ManagedFieldsOperationUpdate,
+					APIVersion: "apps/v1",
+					FieldsType: "FieldsV1",
+					FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+				}},
+			},
+			Spec: appsv1.DeploymentSpec{Replicas: &replicas},
+		}
+	}
+
+	BeforeEach(func() {
+		application = &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "cowsay", Namespace: "default", UID: "cowsay-uid"}}
+		applyOptions, managedFieldsAtApply = nil, nil
+
+		scheme := runtime.NewScheme()
+		Expect(appsv1.AddToScheme(scheme)).Should(Succeed())
+		Expect(gitopsv1.AddToScheme(scheme)).Should(Succeed())
+
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(appsv1.SchemeGroupVersion.WithKind("Deployment"), meta.RESTScopeNamespace)
+
+		// The apply patches are recorded along with the managed fields they found
+		apply := func(ctx context.Context, c client.WithWatch, object client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if patch.Type() == types.ApplyPatchType {
+				options := &client.PatchOptions{}
+				options.ApplyOptions(opts)
+				applyOptions = append(applyOptions, options)
+
+				live := &unstructured.Unstructured{}
+				live.SetGroupVersionKind(object.GetObjectKind().GroupVersionKind())
+				if err := c.Get(ctx, client.ObjectKeyFromObject(object), live); err == nil {
+					managedFieldsAtApply = append(managedFieldsAtApply, live.GetManagedFields())
+				}
+			}
+
+			return fakeApply(ctx, c, object, patch, opts...)
+		}
+
+		reconciler = &ApplicationReconciler{
+			Client:              fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithObjects(legacy()).WithInterceptorFuncs(interceptor.Funcs{Patch: apply}).Build(),
+			Scheme:              scheme,
+			Recorder:            record.NewFakeRecorder(10),
+			LegacyFieldManagers: []string{DefaultLegacyFieldManager},
+		}
+	})
+
+	Context("When applying a manifest", func() {
+		It("Should apply it with the field manager and only force conflicts if asked to", func() {
+			result, err := reconciler.reconcileManifest(ctx, application, manifest(2), false, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result).Should(Equal(gitopsv1.ResourceConfigured))
+
+			result, err = reconciler.reconcileManifest(ctx, application, manifest(3), true, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result).Should(Equal(gitopsv1.ResourceConfigured))
+
+			Expect(applyOptions).Should(HaveLen(2))
+			Expect(applyOptions[0].FieldManager).Should(Equal(DefaultFieldManager))
+			Expect(applyOptions[0].Force).Should(BeNil())
+			Expect(applyOptions[1].Force).ShouldNot(BeNil())
+			Expect(*applyOptions[1].Force).Should(BeTrue())
+
+			deployment := &appsv1.Deployment{}
+			Expect(reconciler.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cowsay"}, deployment)).Should(Succeed())
+			Expect(*deployment.Spec.Replicas).Should(Equal(int32(3)))
+			Expect(deployment.OwnerReferences).Should(HaveLen(1))
+		})
+
+		It("Should report objects that do not exist yet as created", func() {
+			object := manifest(1)
+			object.SetName("cowsay-2")
+
+			result, err := reconciler.reconcileManifest(ctx, application, object, false, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result).Should(Equal(gitopsv1.ResourceCreated))
+		})
+
+		It("Should hand the fields of the legacy field manager over before the first apply", func() {
+			_, err := reconciler.reconcileManifest(ctx, application, manifest(2), false, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(managedFieldsAtApply).Should(HaveLen(1))
+			Expect(managedFieldsAtApply[0]).Should(HaveLen(1))
+			Expect(managedFieldsAtApply[0][0].Manager).Should(Equal(DefaultFieldManager))
+			Expect(managedFieldsAtApply[0][0].Operation).Should(Equal(metav1.ManagedFieldsOperationApply))
+			Expect(string(managedFieldsAtApply[0][0].FieldsV1.Raw)).Should(ContainSubstring("f:replicas"))
+		})
+
+		It("Should leave the managed fields alone without legacy field managers", func() {
+			reconciler.LegacyFieldManagers = nil
+
+			_, err := reconciler.reconcileManifest(ctx, application, manifest(2), false, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(managedFieldsAtApply).Should(HaveLen(1))
+			Expect(managedFieldsAtApply[0][0].Manager).Should(Equal(DefaultLegacyFieldManager))
+		})
+	})
+})
@@ -0,0 +1,139 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// Keys of the Secret referenced by an Application for authenticating against its repository
+const (
+	UsernameSecretKey    = "username"
+	PasswordSecretKey    = "password"
+	BearerTokenSecretKey = "bearerToken"
+	IdentitySecretKey    = "identity"
+	KnownHostsSecretKey  = "known_hosts"
+)
+
+// authMethod returns the go-git authentication for the repository of the Application based on the Secret referenced
+// by spec.secretRef, or nil for public repositories.
+func (r *ApplicationReconciler) authMethod(ctx context.Context, application *gitopsv1.Application) (transport.AuthMethod, error) {
+	if application.Spec.SecretRef == nil {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{}
+	secretName := types.NamespacedName{Namespace: application.Namespace, Name: application.Spec.SecretRef.Name}
+	if err := r.Get(ctx, secretName, secret); err != nil {
+		return nil, fmt.Errorf("failed to get repository secret %s: %w", secretName, err)
+	}
+
+	endpoint, err := transport.NewEndpoint(application.Spec.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse repository URL: %w", err)
+	}
+
+	switch endpoint.Protocol {
+	case "http", "https":
+		return basicOrTokenAuth(secret)
+	case "ssh":
+		return publicKeysAuth(secret, endpoint.User)
+	}
+
+	return nil, fmt.Errorf("authentication is not supported for the %s protocol", endpoint.Protocol)
+}
+
+func basicOrTokenAuth(secret *corev1.Secret) (transport.AuthMethod, error) {
+	if token, ok := secret.Data[BearerTokenSecretKey]; ok {
+		return &http.TokenAuth{Token: string(token)}, nil
+	}
+
+	username, hasUsername := secret.Data[UsernameSecretKey]
+	password, hasPassword := secret.Data[PasswordSecretKey]
+	if !hasUsername && !hasPassword {
+		return nil, fmt.Errorf("secret %s must contain either %s or %s and %s", secret.Name, BearerTokenSecretKey, UsernameSecretKey, PasswordSecretKey)
+	}
+
+	// Token based authentication of most Git hosting providers accepts any non-empty username with the token as password
+	if !hasUsername {
+		username = []byte("git")
+	}
+
+	return &http.BasicAuth{Username: string(username), Password: string(password)}, nil
+}
+
+func publicKeysAuth(secret *corev1.Secret, user string) (transport.AuthMethod, error) {
+	identity, ok := secret.Data[IdentitySecretKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s must contain an %s for SSH repositories", secret.Name, IdentitySecretKey)
+	}
+
+	knownHosts, ok := secret.Data[KnownHostsSecretKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s must contain %s for SSH repositories, host keys are always verified", secret.Name, KnownHostsSecretKey)
+	}
+
+	if user == "" {
+		user = "git"
+	}
+
+	publicKeys, err := ssh.NewPublicKeys(user, identity, string(secret.Data[PasswordSecretKey]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s of secret %s: %w", IdentitySecretKey, secret.Name, err)
+	}
+
+	hostKeyCallback, err := knownHostsCallback(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s of secret %s: %w", KnownHostsSecretKey, secret.Name, err)
+	}
+
+	publicKeys.HostKeyCallback = hostKeyCallback
+
+	return publicKeys, nil
+}
+
+// knownHostsCallback builds a strict host key verification from the content of a known_hosts file. The knownhosts
+// package only reads from files, so the content is written to a temporary one that is removed once it got parsed.
+func knownHostsCallback(knownHosts []byte) (cryptossh.HostKeyCallback, error) {
+	file, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(knownHosts); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	return knownhosts.New(file.Name())
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Repository authentication", func() {
+	secret := func(data map[string][]byte) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"}, Data: data}
+	}
+
+	Context("When authenticating against HTTPS repositories", func() {
+		It("Should prefer a bearer token", func() {
+			auth, err := basicOrTokenAuth(secret(map[string][]byte{BearerTokenSecretKey: []byte("token"), UsernameSecretKey: []byte("potato"), PasswordSecretKey: []byte("secret")}))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(auth).Should(Equal(&http.TokenAuth{Token: "token"}))
+		})
+
+		It("Should use the username and password otherwise", func() {
+			auth, err := basicOrTokenAuth(secret(map[string][]byte{UsernameSecretKey: []byte("potato"), PasswordSecretKey: []byte("secret")}))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(auth).Should(Equal(&http.BasicAuth{Username: "potato", Password: "secret"}))
+		})
+
+		It("Should default the username for a password only", func() {
+			auth, err := basicOrTokenAuth(secret(map[string][]byte{PasswordSecretKey: []byte("secret")}))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(auth).Should(Equal(&http.BasicAuth{Username: "git", Password: "secret"}))
+		})
+
+		It("Should fail without credentials", func() {
+			_, err := basicOrTokenAuth(secret(map[string][]byte{IdentitySecretKey: []byte("key")}))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("When authenticating against SSH repositories", func() {
+		var identity, knownHosts []byte
+		var hostKey cryptossh.PublicKey
+		var temp, previousTemp string
+		var previousTempSet bool
+
+		address := &net.TCPAddr{IP: net.IPv4(140, 82, 121, 4), Port: 22}
+
+		newPublicKey := func() cryptossh.PublicKey {
+			public, _, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			key, err := cryptossh.NewPublicKey(public)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			return key
+		}
+
+		BeforeEach(func() {
+			_, private, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			block, err := cryptossh.MarshalPrivateKey(private, "")
+			Expect(err).ShouldNot(HaveOccurred())
+			identity = pem.EncodeToMemory(block)
+
+			hostKey = newPublicKey()
+			knownHosts = []byte(knownhosts.Line([]string{"github.com"}, hostKey) + "\n")
+
+			// The temporary known_hosts files are created in TMPDIR
+			temp, err = os.MkdirTemp("", "potato-auth-")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			previousTemp, previousTempSet = os.LookupEnv("TMPDIR")
+			Expect(os.Setenv("TMPDIR", temp)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			if previousTempSet {
+				Expect(os.Setenv("TMPDIR", previousTemp)).Should(Succeed())
+			} else {
+				Expect(os.Unsetenv("TMPDIR")).Should(Succeed())
+			}
+
+			Expect(os.RemoveAll(temp)).Should(Succeed())
+		})
+
+		It("Should use the identity with the user of the URL and verify host keys", func() {
+			auth, err := publicKeysAuth(secret(map[string][]byte{IdentitySecretKey: identity, KnownHostsSecretKey: knownHosts}), "deploy")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			publicKeys, ok := auth.(*ssh.PublicKeys)
+			Expect(ok).Should(BeTrue())
+			Expect(publicKeys.User).Should(Equal("deploy"))
+			Expect(publicKeys.HostKeyCallback("github.com:22", address, hostKey)).Should(Succeed())
+		})
+
+		It("Should reject SSH without known_hosts", func() {
+			_, err := publicKeysAuth(secret(map[string][]byte{IdentitySecretKey: identity}), "git")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(KnownHostsSecretKey))
+		})
+
+		It("Should fail on a host key that does not match", func() {
+			callback, err := knownHostsCallback(knownHosts)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			err = callback("github.com:22", address, newPublicKey())
+			Expect(err).Should(HaveOccurred())
+
+			keyErr, ok := err.(*knownhosts.KeyError)
+			Expect(ok).Should(BeTrue())
+			Expect(keyErr.Want).ShouldNot(BeEmpty())
+		})
+
+		It("Should fail on a host that is not known", func() {
+			callback, err := knownHostsCallback(knownHosts)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(callback("gitlab.com:22", address, hostKey)).ShouldNot(Succeed())
+		})
+
+		It("Should remove the temporary known_hosts file", func() {
+			_, err := knownHostsCallback(knownHosts)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			entries, err := os.ReadDir(temp)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(entries).Should(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,484 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-logr/logr"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// DefaultCacheDir is where repositories are cached if the controller is not configured otherwise
+const DefaultCacheDir = "/tmp/potato"
+
+// DefaultGarbageCollectionInterval is how often orphaned cache entries are looked for
+const DefaultGarbageCollectionInterval = 10 * time.Minute
+
+// garbageCollectionGracePeriod keeps cache entries that were used recently, even if no Application seems to need them,
+// as the list of Applications may be out of date
+const garbageCollectionGracePeriod = 10 * time.Minute
+
+// RepositoryCache stores the repositories of Applications in a directory that can outlive the controller, e.g. a
+// PersistentVolumeClaim. Every remote is kept once as a bare mirror under mirrors/, keyed by the hash of its normalized
+// URL, so Applications following the same repository share it. The files of the revision an Application is synced to
+// are exported to worktrees/<namespace>/<name>/<revision>.
+type RepositoryCache struct {
+	// Root directory of the cache
+	Root string
+	// MaxSize of the mirrors in bytes, the least recently used ones are evicted beyond it. Worktrees are not counted,
+	// as they hold the revisions the Applications are synced to and cannot be evicted. Unbounded if zero
+	MaxSize int64
+
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewRepositoryCache returns a cache storing its entries in root.
+func NewRepositoryCache(root string, maxSize int64) *RepositoryCache {
+	return &RepositoryCache{Root: root, MaxSize: maxSize, locks: map[string]*sync.Mutex{}}
+}
+
+// cacheKey returns the name of the mirror of a remote. The HTTPS and SSH URLs of a repository share the same mirror.
+func cacheKey(url string) string {
+	normalized := normalizeRepositoryURL(url)
+	if normalized == "" {
+		normalized = url
+	}
+
+	sum := sha256.Sum256([]byte(normalized))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *RepositoryCache) mirrorsDir() string {
+	return filepath.Join(c.Root, "mirrors")
+}
+
+func (c *RepositoryCache) worktreesDir() string {
+	return filepath.Join(c.Root, "worktrees")
+}
+
+// mirrorLock returns the lock serializing the use of a mirror.
+func (c *RepositoryCache) mirrorLock(key string) *sync.Mutex {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.locks == nil {
+		c.locks = map[string]*sync.Mutex{}
+	}
+
+	lock, ok := c.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.locks[key] = lock
+	}
+
+	return lock
+}
+
+// Checkout brings the mirror of the repository up to date, resolves ref with resolve and exports the files of the
+// resulting commit to the worktree of the Application. It returns the commit SHA, the worktree and whether the mirror
+// had to be cloned first.
+func (c *RepositoryCache) Checkout(ctx context.Context, application *gitopsv1.Application, auth transport.AuthMethod, resolve func(*git.Repository) (plumbing.Hash, error), logger logr.Logger) (string, string, bool, error) {
+	key := cacheKey(application.Spec.Repository)
+	lock := c.mirrorLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	mirror, cloned, err := c.fetchMirror(ctx, key, application.Spec.Repository, auth, logger)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	hash, err := resolve(mirror)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	worktree, err := c.exportWorktree(mirror, application, hash, logger)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return hash.String(), worktree, cloned, nil
+}
+
+// Worktree returns the worktree of the Application at revision if it was exported before.
+func (c *RepositoryCache) Worktree(application *gitopsv1.Application, revision string) (string, bool) {
+	if revision == "" {
+		return "", false
+	}
+
+	worktree := filepath.Join(c.worktreesDir(), application.Namespace, application.Name, revision)
+	if _, err := os.Stat(worktree); err != nil {
+		return "", false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(worktree, now, now)
+
+	return worktree, true
+}
+
+// fetchMirror fetches all branches and tags of the remote into its bare mirror, creating the mirror first if needed.
+func (c *RepositoryCache) fetchMirror(ctx context.Context, key, url string, auth transport.AuthMethod, logger logr.Logger) (*git.Repository, bool, error) {
+	path := filepath.Join(c.mirrorsDir(), key)
+	cloned := false
+
+	repository, err := git.PlainOpen(path)
+	if err == git.ErrRepositoryNotExists {
+		logger.Info("Creating mirror of: " + url + " in: " + path)
+
+		repository, err = git.PlainInit(path, true)
+		if err != nil {
+			logger.Error(err, "Failed to create mirror: "+path)
+			return nil, false, err
+		}
+
+		cloned = true
+	} else if err != nil {
+		logger.Error(err, "Failed to open mirror: "+path)
+		return nil, false, err
+	}
+
+	// The mirror may have been created for another URL of the same repository, e.g. SSH instead of HTTPS
+	remote, err := repository.Remote(git.DefaultRemoteName)
+	if err != nil || remote.Config().URLs[0] != url {
+		if err == nil {
+			_ = repository.DeleteRemote(git.DefaultRemoteName)
+		}
+
+		if _, err := repository.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{url}}); err != nil {
+			logger.Error(err, "Failed to configure remote of mirror: "+path)
+			return nil, false, err
+		}
+	}
+
+	logger.Info("Fetching changes into mirror: " + path)
+
+	err = repository.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+		Auth:       auth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		logger.Error(err, "Failed to fetch changes...")
+
+		// Do not keep a mirror that never got anything into it
+		if cloned {
+			_ = os.RemoveAll(path)
+		}
+
+		return nil, false, err
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	// Fetches grow mirrors just like clones add them
+	c.evict(key, logger)
+
+	return repository, cloned, nil
+}
+
+// exportWorktree writes the files of commit hash to the worktree of the Application, unless they are there already,
+// and removes the worktrees of previous revisions. Symbolic links are skipped, so the files of a repository cannot
+// point outside of it.
+func (c *RepositoryCache) exportWorktree(repository *git.Repository, application *gitopsv1.Application, hash plumbing.Hash, logger logr.Logger) (string, error) {
+	parent := filepath.Join(c.worktreesDir(), application.Namespace, application.Name)
+	worktree := filepath.Join(parent, hash.String())
+
+	now := time.Now()
+
+	if _, err := os.Stat(worktree); err == nil {
+		_ = os.Chtimes(worktree, now, now)
+		return worktree, nil
+	}
+
+	commit, err := repository.CommitObject(hash)
+	if err != nil {
+		logger.Error(err, "Failed to get commit: "+hash.String())
+		return "", err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		logger.Error(err, "Failed to get tree of commit: "+hash.String())
+		return "", err
+	}
+
+	logger.Info("Exporting revision: " + hash.String() + " to: " + worktree)
+
+	// Export next to the worktree and move it in place at once, so an interrupted export is not mistaken for a worktree
+	staging := worktree + ".tmp"
+	if err := os.RemoveAll(staging); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		logger.Error(err, "Failed to create worktree: "+staging)
+		return "", err
+	}
+
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if file.Mode == filemode.Symlink {
+			logger.Info("Skipping symbolic link: " + file.Name)
+			return nil
+		}
+
+		return exportFile(file, filepath.Join(staging, filepath.FromSlash(file.Name)))
+	})
+	if err != nil {
+		logger.Error(err, "Failed to export revision: "+hash.String())
+		_ = os.RemoveAll(staging)
+		return "", err
+	}
+
+	if err := os.Rename(staging, worktree); err != nil {
+		logger.Error(err, "Failed to move worktree in place: "+worktree)
+		_ = os.RemoveAll(staging)
+		return "", err
+	}
+
+	entries, _ := os.ReadDir(parent)
+	for _, entry := range entries {
+		if entry.Name() != hash.String() {
+			_ = os.RemoveAll(filepath.Join(parent, entry.Name()))
+		}
+	}
+
+	return worktree, nil
+}
+
+func exportFile(file *object.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	mode := fs.FileMode(0644)
+	if file.Mode == filemode.Executable {
+		mode = 0755
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+// cacheEntry is a mirror or worktree in the cache.
+type cacheEntry struct {
+	path     string
+	key      string
+	lastUsed time.Time
+	size     int64
+}
+
+// mirrorEntries lists the mirrors in the cache with their size.
+func (c *RepositoryCache) mirrorEntries() ([]cacheEntry, error) {
+	dirs, err := os.ReadDir(c.mirrorsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []cacheEntry
+	for _, dir := range dirs {
+		info, err := dir.Info()
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(c.mirrorsDir(), dir.Name())
+		entries = append(entries, cacheEntry{path: path, key: dir.Name(), lastUsed: info.ModTime(), size: dirSize(path)})
+	}
+
+	return entries, nil
+}
+
+func dirSize(path string) int64 {
+	var size int64
+
+	_ = filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
+
+// evict removes the least recently used mirrors until the mirrors fit into MaxSize. The mirror in use by the caller and
+// mirrors in use by others are kept.
+func (c *RepositoryCache) evict(inUse string, logger logr.Logger) {
+	if c.MaxSize <= 0 {
+		return
+	}
+
+	entries, err := c.mirrorEntries()
+	if err != nil {
+		logger.Error(err, "Failed to list mirrors for eviction")
+		return
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed.Before(entries[j].lastUsed) })
+
+	for _, entry := range entries {
+		if total <= c.MaxSize {
+			return
+		}
+
+		if entry.key == inUse {
+			continue
+		}
+
+		lock := c.mirrorLock(entry.key)
+		if !lock.TryLock() {
+			continue
+		}
+
+		logger.Info(fmt.Sprintf("Evicting mirror: %s of %d bytes, the cache exceeds %d bytes", entry.path, entry.size, c.MaxSize))
+		if err := os.RemoveAll(entry.path); err != nil {
+			logger.Error(err, "Failed to evict mirror: "+entry.path)
+		} else {
+			total -= entry.size
+		}
+
+		lock.Unlock()
+	}
+}
+
+// CollectGarbage removes the worktrees of Applications that do not exist anymore and the mirrors no Application uses.
+// Entries used within the grace period are kept, so a stale list of Applications does not remove anything in use. The
+// mirrors are then evicted down to MaxSize.
+func (c *RepositoryCache) CollectGarbage(applications []gitopsv1.Application, logger logr.Logger) {
+	worktrees := map[string]bool{}
+	mirrors := map[string]bool{}
+
+	for _, application := range applications {
+		worktrees[filepath.Join(application.Namespace, application.Name)] = true
+		mirrors[cacheKey(application.Spec.Repository)] = true
+	}
+
+	cutoff := time.Now().Add(-garbageCollectionGracePeriod)
+
+	namespaces, _ := os.ReadDir(c.worktreesDir())
+	for _, namespace := range namespaces {
+		names, _ := os.ReadDir(filepath.Join(c.worktreesDir(), namespace.Name()))
+		for _, name := range names {
+			path := filepath.Join(c.worktreesDir(), namespace.Name(), name.Name())
+			if worktrees[filepath.Join(namespace.Name(), name.Name())] || recentlyUsed(path, cutoff) {
+				continue
+			}
+
+			logger.Info("Removing worktree of deleted Application: " + path)
+			if err := os.RemoveAll(path); err != nil {
+				logger.Error(err, "Failed to remove worktree: "+path)
+			}
+		}
+	}
+
+	entries, err := c.mirrorEntries()
+	if err != nil {
+		logger.Error(err, "Failed to list mirrors for garbage collection")
+		return
+	}
+
+	for _, entry := range entries {
+		if mirrors[entry.key] || entry.lastUsed.After(cutoff) {
+			continue
+		}
+
+		lock := c.mirrorLock(entry.key)
+		if !lock.TryLock() {
+			continue
+		}
+
+		logger.Info("Removing mirror no Application uses: " + entry.path)
+		if err := os.RemoveAll(entry.path); err != nil {
+			logger.Error(err, "Failed to remove mirror: "+entry.path)
+		}
+
+		lock.Unlock()
+	}
+
+	c.evict("", logger)
+}
+
+// recentlyUsed tells whether the worktree of an Application or any of its revisions was used after cutoff.
+func recentlyUsed(path string, cutoff time.Time) bool {
+	paths := []string{path}
+
+	entries, _ := os.ReadDir(path)
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(path, entry.Name()))
+	}
+
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(cutoff) {
+			return true
+		}
+	}
+
+	return false
+}
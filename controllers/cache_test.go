@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Repository cache", func() {
+	var source string
+	var cache *RepositoryCache
+
+	commit := func(repository *git.Repository, file, content string) plumbing.Hash {
+		worktree, err := repository.Worktree()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(os.MkdirAll(filepath.Dir(filepath.Join(source, file)), 0755)).Should(Succeed())
+		Expect(os.WriteFile(filepath.Join(source, file), []byte(content), 0644)).Should(Succeed())
+		_, err = worktree.Add(file)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		hash, err := worktree.Commit("Update "+file, &git.CommitOptions{Author: &object.Signature{Name: "potato", When: time.Now()}})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		return hash
+	}
+
+	application := func(name string) *gitopsv1.Application {
+		return &gitopsv1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       gitopsv1.ApplicationSpec{Repository: source, Ref: &gitopsv1.GitReference{Branch: "master"}},
+		}
+	}
+
+	checkout := func(application *gitopsv1.Application) (string, string, bool) {
+		resolve := func(repository *git.Repository) (plumbing.Hash, error) {
+			return resolveRef(repository, application.Spec.Ref, logf.Log)
+		}
+
+		revision, worktree, cloned, err := cache.Checkout(context.Background(), application, nil, resolve, logf.Log)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		return revision, worktree, cloned
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		source, err = os.MkdirTemp("", "potato-source")
+		Expect(err).ShouldNot(HaveOccurred())
+		root, err := os.MkdirTemp("", "potato-cache")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache = NewRepositoryCache(root, 0)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(source)).Should(Succeed())
+		Expect(os.RemoveAll(cache.Root)).Should(Succeed())
+	})
+
+	Context("When checking out Applications", func() {
+		It("Should share the mirror and export a worktree per revision", func() {
+			repository, err := git.PlainInit(source, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			first := commit(repository, "kubernetes/cowsay.yaml", "first")
+
+			revision, worktree, cloned := checkout(application("cowsay"))
+			Expect(revision).Should(Equal(first.String()))
+			Expect(cloned).Should(BeTrue())
+			Expect(os.ReadFile(filepath.Join(worktree, "kubernetes", "cowsay.yaml"))).Should(BeEquivalentTo("first"))
+
+			second := commit(repository, "kubernetes/cowsay.yaml", "second")
+
+			_, _, cloned = checkout(application("cowsay-2"))
+			Expect(cloned).Should(BeFalse())
+
+			revision, worktree, _ = checkout(application("cowsay"))
+			Expect(revision).Should(Equal(second.String()))
+			Expect(os.ReadFile(filepath.Join(worktree, "kubernetes", "cowsay.yaml"))).Should(BeEquivalentTo("second"))
+
+			// The worktree of the previous revision is gone
+			Expect(os.ReadDir(filepath.Dir(worktree))).Should(HaveLen(1))
+		})
+	})
+
+	Context("When the mirrors exceed the maximum size", func() {
+		var other string
+
+		BeforeEach(func() {
+			// A mirror of another repository, used before the one of the source
+			other = filepath.Join(cache.mirrorsDir(), cacheKey("https://github.com/uvegla/application-2"))
+			Expect(os.MkdirAll(other, 0755)).Should(Succeed())
+			Expect(os.WriteFile(filepath.Join(other, "pack"), make([]byte, 4096), 0644)).Should(Succeed())
+
+			past := time.Now().Add(-time.Minute)
+			Expect(os.Chtimes(other, past, past)).Should(Succeed())
+		})
+
+		It("Should evict the least recently used mirrors after fetching an existing mirror", func() {
+			repository, err := git.PlainInit(source, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			commit(repository, "kubernetes/cowsay.yaml", "first")
+
+			checkout(application("cowsay"))
+			Expect(other).Should(BeADirectory())
+
+			cache.MaxSize = 1
+			_, _, cloned := checkout(application("cowsay"))
+			Expect(cloned).Should(BeFalse())
+
+			Expect(other).ShouldNot(BeADirectory())
+			Expect(filepath.Join(cache.mirrorsDir(), cacheKey(source))).Should(BeADirectory())
+		})
+
+		It("Should evict mirrors when collecting garbage", func() {
+			cache.MaxSize = 1
+
+			cache.CollectGarbage([]gitopsv1.Application{{Spec: gitopsv1.ApplicationSpec{Repository: "https://github.com/uvegla/application-2"}}}, logf.Log)
+
+			Expect(other).ShouldNot(BeADirectory())
+		})
+	})
+
+	Context("When collecting garbage", func() {
+		It("Should remove the entries of deleted Applications that were not used recently", func() {
+			repository, err := git.PlainInit(source, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			commit(repository, "kubernetes/cowsay.yaml", "first")
+
+			_, worktree, _ := checkout(application("cowsay"))
+
+			cache.CollectGarbage(nil, logf.Log)
+			Expect(worktree).Should(BeADirectory())
+
+			past := time.Now().Add(-2 * garbageCollectionGracePeriod)
+			Expect(os.Chtimes(worktree, past, past)).Should(Succeed())
+			Expect(os.Chtimes(filepath.Dir(worktree), past, past)).Should(Succeed())
+			Expect(os.Chtimes(filepath.Join(cache.mirrorsDir(), cacheKey(source)), past, past)).Should(Succeed())
+
+			cache.CollectGarbage(nil, logf.Log)
+			Expect(filepath.Dir(worktree)).ShouldNot(BeADirectory())
+			Expect(os.ReadDir(cache.mirrorsDir())).Should(BeEmpty())
+		})
+	})
+})
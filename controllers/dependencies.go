@@ -0,0 +1,166 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// dependsOnIndex is the field index of Applications by the Applications they depend on
+const dependsOnIndex = ".spec.dependsOn"
+
+// dependencyName returns the namespaced name of a dependency of the Application.
+func dependencyName(application *gitopsv1.Application, dependency gitopsv1.ApplicationReference) types.NamespacedName {
+	namespace := dependency.Namespace
+	if namespace == "" {
+		namespace = application.Namespace
+	}
+
+	return types.NamespacedName{Namespace: namespace, Name: dependency.Name}
+}
+
+// indexDependencies indexes an Application by the namespaced names of its dependencies.
+func indexDependencies(object client.Object) []string {
+	application, ok := object.(*gitopsv1.Application)
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	for _, dependency := range application.Spec.DependsOn {
+		names = append(names, dependencyName(application, dependency).String())
+	}
+
+	return names
+}
+
+// dependencyReady tells whether an Application is Ready and Healthy at its latest revision, or why not. A sync is Ready
+// as soon as it is applied, while its objects may still be rolling out, so the health has to be assessed as well.
+func dependencyReady(dependency *gitopsv1.Application) (bool, string) {
+	ready := meta.FindStatusCondition(dependency.Status.Conditions, gitopsv1.ReadyCondition)
+	healthy := meta.FindStatusCondition(dependency.Status.Conditions, gitopsv1.HealthyCondition)
+
+	switch {
+	case dependency.Status.ObservedGeneration != dependency.Generation || ready == nil || ready.ObservedGeneration != dependency.Generation:
+		return false, "Its latest spec is not synced yet"
+	case ready.Status != metav1.ConditionTrue:
+		return false, "Not Ready: " + ready.Message
+	case dependency.Status.LastAppliedRevision != dependency.Status.LastAttemptedRevision:
+		return false, "Revision " + dependency.Status.LastAttemptedRevision + " is not applied yet"
+	case healthy == nil || healthy.ObservedGeneration != dependency.Generation || healthy.Status != metav1.ConditionTrue:
+		message := "Health is not assessed yet"
+		if healthy != nil {
+			message = "Not Healthy: " + healthy.Message
+		}
+		return false, message
+	}
+
+	return true, ""
+}
+
+// checkDependencies tells whether all dependencies of the Application are Ready at their latest revision. Otherwise the
+// Application is held in the DependencyNotReady state, until a change to a dependency requeues it.
+func (r *ApplicationReconciler) checkDependencies(ctx context.Context, application *gitopsv1.Application, logger logr.Logger) (bool, error) {
+	for _, ref := range application.Spec.DependsOn {
+		name := dependencyName(application, ref)
+
+		message := ""
+		if name.Namespace == application.Namespace && name.Name == application.Name {
+			message = "The Application depends on itself"
+		} else {
+			dependency := &gitopsv1.Application{}
+			if err := r.Get(ctx, name, dependency); err != nil {
+				if !errors.IsNotFound(err) {
+					logger.Error(err, "Failed to get dependency: "+name.String())
+					return false, err
+				}
+
+				message = "Not found"
+			} else if ready, reason := dependencyReady(dependency); !ready {
+				message = reason
+			}
+		}
+
+		if message == "" {
+			continue
+		}
+
+		message = fmt.Sprintf("Dependency %s: %s", name, message)
+		if synced := meta.FindStatusCondition(application.Status.Conditions, gitopsv1.SyncedCondition); synced == nil || synced.Reason != gitopsv1.DependencyNotReadyReason {
+			r.Recorder.Event(application, corev1.EventTypeNormal, gitopsv1.DependencyNotReadyReason, message)
+		}
+
+		logger.Info(message)
+		markWaiting(application, gitopsv1.DependencyNotReadyReason, message)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// dependentApplications maps an Application to the Applications depending on it, so they are synced once it changes.
+func (r *ApplicationReconciler) dependentApplications(ctx context.Context, object client.Object) []reconcile.Request {
+	applications := &gitopsv1.ApplicationList{}
+	if err := r.List(ctx, applications, client.MatchingFields{dependsOnIndex: client.ObjectKeyFromObject(object).String()}); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, application := range applications.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&application)})
+	}
+
+	return requests
+}
+
+// dependencyChangedPredicate passes the changes of an Application that matter to the Applications depending on it:
+// when it appears, disappears, or becomes ready or not ready.
+var dependencyChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		previous, ok := e.ObjectOld.(*gitopsv1.Application)
+		if !ok {
+			return false
+		}
+
+		current, ok := e.ObjectNew.(*gitopsv1.Application)
+		if !ok {
+			return false
+		}
+
+		previousReady, _ := dependencyReady(previous)
+		currentReady, _ := dependencyReady(current)
+
+		return previousReady != currentReady
+	},
+	GenericFunc: func(e event.GenericEvent) bool {
+		return false
+	},
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Dependencies", func() {
+	ctx := context.Background()
+
+	var reconciler *ApplicationReconciler
+	var platform, product *gitopsv1.Application
+
+	BeforeEach(func() {
+		platform = &gitopsv1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: "platform", Namespace: "infra", Generation: 1},
+			Status: gitopsv1.ApplicationStatus{
+				ObservedGeneration:    1,
+				LastAppliedRevision:   "0123456789abcdef",
+				LastAttemptedRevision: "0123456789abcdef",
+				Conditions: []metav1.Condition{{
+					Type: gitopsv1.ReadyCondition, Status: metav1.ConditionTrue, ObservedGeneration: 1, Reason: gitopsv1.SyncSucceededReason,
+				}, {
+					Type: gitopsv1.HealthyCondition, Status: metav1.ConditionTrue, ObservedGeneration: 1, Reason: gitopsv1.HealthyReason,
+				}},
+			},
+		}
+
+		product = &gitopsv1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: "product", Namespace: "default", Generation: 1},
+			Spec:       gitopsv1.ApplicationSpec{DependsOn: []gitopsv1.ApplicationReference{{Namespace: "infra", Name: "platform"}}},
+		}
+		markProgressing(product)
+
+		scheme := runtime.NewScheme()
+		Expect(gitopsv1.AddToScheme(scheme)).Should(Succeed())
+
+		reconciler = &ApplicationReconciler{
+			Client:   fake.NewClientBuilder().WithScheme(scheme).WithIndex(&gitopsv1.Application{}, dependsOnIndex, indexDependencies).WithObjects(platform, product).Build(),
+			Scheme:   scheme,
+			Recorder: record.NewFakeRecorder(10),
+		}
+	})
+
+	Context("When the dependencies are Ready at their latest revision", func() {
+		It("Should sync the Application", func() {
+			ready, err := reconciler.checkDependencies(ctx, product, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ready).Should(BeTrue())
+		})
+	})
+
+	Context("When a dependency is not Ready at its latest revision", func() {
+		It("Should hold the Application while a new revision is being applied", func() {
+			platform.Status.LastAttemptedRevision = "fedcba9876543210"
+			Expect(reconciler.Update(ctx, platform)).Should(Succeed())
+
+			ready, err := reconciler.checkDependencies(ctx, product, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ready).Should(BeFalse())
+
+			condition := meta.FindStatusCondition(product.Status.Conditions, gitopsv1.ReadyCondition)
+			Expect(condition.Reason).Should(Equal(gitopsv1.DependencyNotReadyReason))
+			Expect(condition.Message).Should(ContainSubstring("infra/platform"))
+		})
+
+		It("Should hold the Application while the objects of the dependency are still progressing", func() {
+			meta.SetStatusCondition(&platform.Status.Conditions, metav1.Condition{
+				Type: gitopsv1.HealthyCondition, Status: metav1.ConditionUnknown, ObservedGeneration: 1, Reason: gitopsv1.ProgressingReason, Message: "Deployment infra/ingress is progressing",
+			})
+			Expect(reconciler.Update(ctx, platform)).Should(Succeed())
+
+			ready, err := reconciler.checkDependencies(ctx, product, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ready).Should(BeFalse())
+			Expect(meta.FindStatusCondition(product.Status.Conditions, gitopsv1.ReadyCondition).Message).Should(ContainSubstring("Deployment infra/ingress is progressing"))
+		})
+
+		It("Should hold the Application while the dependency does not exist", func() {
+			product.Spec.DependsOn = []gitopsv1.ApplicationReference{{Name: "missing"}}
+
+			ready, err := reconciler.checkDependencies(ctx, product, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ready).Should(BeFalse())
+			Expect(meta.FindStatusCondition(product.Status.Conditions, gitopsv1.ReadyCondition).Message).Should(ContainSubstring("default/missing"))
+		})
+	})
+
+	Context("When a dependency changes", func() {
+		It("Should requeue the Applications depending on it", func() {
+			requests := reconciler.dependentApplications(ctx, platform)
+
+			Expect(requests).Should(Equal([]reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "product"}}}))
+		})
+	})
+})
@@ -0,0 +1,220 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// ApprovedRevisionAnnotation approves syncing a revision of an Application with the manual sync policy when set to the
+// pending revision
+const ApprovedRevisionAnnotation = "gitops.potato.io/approved-revision"
+
+// ignoredFields are maintained by the API server and are not reported as changes
+var ignoredFields = [][]string{
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "generation"},
+	{"metadata", "creationTimestamp"},
+	{"metadata", "uid"},
+	{"status"},
+}
+
+// needsApproval tells whether the revision has to be approved before it gets applied.
+func needsApproval(application *gitopsv1.Application, revision string) bool {
+	return application.Spec.SyncPolicy == gitopsv1.SyncPolicyManual && application.Annotations[ApprovedRevisionAnnotation] != revision
+}
+
+// planSync finds out what syncing the revision would change with a server-side dry-run of every object, without
+// applying anything, and records the changes in the status of the Application.
+func (r *ApplicationReconciler) planSync(ctx context.Context, application *gitopsv1.Application, revision string, objects []*unstructured.Unstructured, logger logr.Logger) error {
+	var changes []gitopsv1.ResourceChange
+	var current []gitopsv1.ResourceReference
+
+	for _, object := range objects {
+		change, _, err := r.diffManifest(ctx, application, object, false, logger)
+		if err != nil {
+			logger.Error(err, "Failed to dry-run manifest: "+resourceReferenceString(resourceReferenceOf(object)))
+			markFailed(application, gitopsv1.ApplyFailedReason, err, false)
+			return err
+		}
+
+		if change != nil {
+			changes = append(changes, *change)
+		}
+
+		current = append(current, resourceReferenceOf(object))
+	}
+
+	if application.Spec.Prune {
+		for _, ref := range staleResources(application.Status.Inventory, current) {
+			changes = append(changes, gitopsv1.ResourceChange{ResourceReference: ref, Action: gitopsv1.ChangePrune})
+		}
+	}
+
+	if len(changes) == 0 {
+		logger.Info("Revision has no changes to apply: " + revision)
+		application.Status.PendingRevision = ""
+		application.Status.PendingChanges = nil
+		markSynced(application, revision)
+		return nil
+	}
+
+	application.Status.PendingRevision = revision
+	application.Status.PendingChanges = changes
+
+	counts := map[string]int{}
+	for _, change := range changes {
+		counts[change.Action]++
+	}
+
+	message := fmt.Sprintf("Revision %s would create %d, update %d and prune %d objects, approve it with the %s annotation",
+		revision, counts[gitopsv1.ChangeCreate], counts[gitopsv1.ChangeUpdate], counts[gitopsv1.ChangePrune], ApprovedRevisionAnnotation)
+
+	logger.Info(message)
+
+	// Only report a revision once, not on every interval
+	if pending := meta.FindStatusCondition(application.Status.Conditions, gitopsv1.SyncedCondition); pending == nil || pending.Message != message {
+		r.Recorder.Event(application, corev1.EventTypeNormal, gitopsv1.ChangesPendingReason, message)
+	}
+
+	setCondition(application, gitopsv1.SyncedCondition, metav1.ConditionFalse, gitopsv1.ChangesPendingReason, message)
+	setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionFalse, gitopsv1.ChangesPendingReason, message)
+	setCondition(application, gitopsv1.StalledCondition, metav1.ConditionFalse, gitopsv1.ChangesPendingReason, message)
+
+	return nil
+}
+
+// diffManifest performs a server-side dry-run of applying a single manifest and returns the change it would make, or
+// nil if the live object already matches it, along with the result of the dry-run. The manifest itself is left as it
+// is, so it can still be applied. Namespaces that would be created are not created. With force the dry-run takes over
+// conflicting fields, like reverting drift does.
+func (r *ApplicationReconciler) diffManifest(ctx context.Context, owner *gitopsv1.Application, object *unstructured.Unstructured, force bool, logger logr.Logger) (*gitopsv1.ResourceChange, *unstructured.Unstructured, error) {
+	if err := r.prepareManifest(ctx, owner, object, false, logger); err != nil {
+		return nil, nil, err
+	}
+
+	change := &gitopsv1.ResourceChange{ResourceReference: resourceReferenceOf(object), Action: gitopsv1.ChangeCreate}
+
+	if namespace := object.GetNamespace(); namespace != "" && owner.Spec.CreateNamespace {
+		err := r.Get(ctx, types.NamespacedName{Name: namespace}, &corev1.Namespace{})
+		if errors.IsNotFound(err) {
+			return change, object, nil
+		} else if err != nil {
+			return nil, nil, &FailedToReconcileManifest{Err: err}
+		}
+	}
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(object.GroupVersionKind())
+	if err := r.Get(ctx, client.ObjectKeyFromObject(object), existing); err != nil && !errors.IsNotFound(err) {
+		return nil, nil, &FailedToReconcileManifest{Err: err}
+	}
+
+	// Only the ownership of the fields changes, the dry-run would conflict with the legacy field managers otherwise
+	if err := r.upgradeManagedFields(ctx, existing, logger); err != nil {
+		return nil, nil, &FailedToReconcileManifest{Err: err}
+	}
+
+	dryRun := object.DeepCopy()
+	if err := r.Patch(ctx, dryRun, client.Apply, append(r.applyOptions(force), client.DryRunAll)...); err != nil {
+		return nil, nil, &FailedToReconcileManifest{Err: err}
+	}
+
+	if existing.GetResourceVersion() == "" {
+		return change, dryRun, nil
+	}
+
+	change.Action = gitopsv1.ChangeUpdate
+	change.Fields = changedFields(existing.Object, dryRun.Object)
+
+	if len(change.Fields) == 0 {
+		return nil, dryRun, nil
+	}
+
+	return change, dryRun, nil
+}
+
+// changedFields returns the sorted paths of the fields that differ between the live and the dry-run object. Lists are
+// compared as a whole.
+func changedFields(live, desired map[string]interface{}) []string {
+	live, desired = withoutIgnoredFields(live), withoutIgnoredFields(desired)
+
+	var fields []string
+	collectChangedFields(live, desired, "", &fields)
+	sort.Strings(fields)
+
+	return fields
+}
+
+func withoutIgnoredFields(object map[string]interface{}) map[string]interface{} {
+	object = (&unstructured.Unstructured{Object: object}).DeepCopy().Object
+	for _, field := range ignoredFields {
+		unstructured.RemoveNestedField(object, field...)
+	}
+
+	return object
+}
+
+func collectChangedFields(live, desired interface{}, path string, fields *[]string) {
+	liveMap, liveIsMap := live.(map[string]interface{})
+	desiredMap, desiredIsMap := desired.(map[string]interface{})
+
+	if !liveIsMap || !desiredIsMap {
+		if !reflect.DeepEqual(live, desired) {
+			*fields = append(*fields, path)
+		}
+		return
+	}
+
+	keys := map[string]bool{}
+	for key := range liveMap {
+		keys[key] = true
+	}
+	for key := range desiredMap {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		child := key
+		if path != "" {
+			child = path + "." + key
+		}
+
+		// Keys with dots, e.g. annotations, are put in brackets to keep the path readable
+		if strings.Contains(key, ".") {
+			child = path + "[" + key + "]"
+		}
+
+		collectChangedFields(liveMap[key], desiredMap[key], child, fields)
+	}
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Dry-run diff", func() {
+	Context("When comparing the live object with the dry-run result", func() {
+		live := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":            "cowsay",
+				"resourceVersion": "1",
+				"annotations":     map[string]interface{}{"example.com/owner": "potato"},
+			},
+			"spec":   map[string]interface{}{"replicas": int64(1), "paused": false},
+			"status": map[string]interface{}{"replicas": int64(1)},
+		}
+
+		It("Should report the paths of the changed fields", func() {
+			desired := map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":            "cowsay",
+					"resourceVersion": "2",
+					"annotations":     map[string]interface{}{"example.com/owner": "tomato"},
+				},
+				"spec":   map[string]interface{}{"replicas": int64(2), "paused": false},
+				"status": map[string]interface{}{"replicas": int64(2)},
+			}
+
+			Expect(changedFields(live, desired)).Should(Equal([]string{"metadata.annotations[example.com/owner]", "spec.replicas"}))
+		})
+
+		It("Should ignore fields maintained by the API server", func() {
+			desired := map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":            "cowsay",
+					"resourceVersion": "2",
+					"annotations":     map[string]interface{}{"example.com/owner": "potato"},
+				},
+				"spec":   map[string]interface{}{"replicas": int64(1), "paused": false},
+				"status": map[string]interface{}{"replicas": int64(3)},
+			}
+
+			Expect(changedFields(live, desired)).Should(BeEmpty())
+		})
+	})
+
+	Context("When reporting drift", func() {
+		It("Should list the drifted objects with their fields", func() {
+			drift := []gitopsv1.ResourceChange{
+				{ResourceReference: gitopsv1.ResourceReference{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "cowsay"}, Action: gitopsv1.ChangeUpdate, Fields: []string{"spec.replicas", "spec.template.spec.containers"}},
+				{ResourceReference: gitopsv1.ResourceReference{Kind: "Service", Namespace: "default", Name: "cowsay"}, Action: gitopsv1.ChangeCreate},
+			}
+
+			Expect(driftMessage(drift)).Should(Equal("Deployment.apps default/cowsay (spec.replicas, spec.template.spec.containers); Service default/cowsay (missing)"))
+		})
+	})
+})
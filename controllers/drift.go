@@ -0,0 +1,118 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// inSync tells whether the revision and the spec of the Application already got applied by the last sync, so applying
+// them again would only revert drift. Requested syncs always apply.
+func inSync(application *gitopsv1.Application, revision string) bool {
+	return revision == application.Status.LastAppliedRevision &&
+		application.Generation == application.Status.ObservedGeneration &&
+		meta.IsStatusConditionTrue(application.Status.Conditions, gitopsv1.SyncedCondition) &&
+		application.Annotations[ReconcileRequestAnnotation] == application.Status.LastHandledReconcileAt
+}
+
+// selfHeal tells whether drift is reverted for the Application. Unless set, drift is only reported with the manual sync
+// policy, as nothing is applied without an approval.
+func selfHeal(application *gitopsv1.Application) bool {
+	if application.Spec.SelfHeal != nil {
+		return *application.Spec.SelfHeal
+	}
+
+	return application.Spec.SyncPolicy != gitopsv1.SyncPolicyManual
+}
+
+// detectDrift compares the live objects with the desired state using a server-side dry-run of every manifest. Fields
+// the manifests do not set are not drift, as they are owned by someone else. Reverting the drift takes over the fields
+// of the manifests from whoever changed them. The dry-run results are returned as well,
+// they carry the live status of the objects.
+func (r *ApplicationReconciler) detectDrift(ctx context.Context, application *gitopsv1.Application, objects []*unstructured.Unstructured, logger logr.Logger) ([]gitopsv1.ResourceChange, []*unstructured.Unstructured, error) {
+	var drift []gitopsv1.ResourceChange
+	var live []*unstructured.Unstructured
+
+	for _, object := range objects {
+		// Edits with kubectl take over the ownership of the fields they change, which would make the dry-run conflict
+		change, dryRun, err := r.diffManifest(ctx, application, object, true, logger)
+		if err != nil {
+			logger.Error(err, "Failed to check manifest for drift: "+resourceReferenceString(resourceReferenceOf(object)))
+			return nil, nil, err
+		}
+
+		if change != nil {
+			logger.Info("Object drifted: " + resourceReferenceString(change.ResourceReference))
+			drift = append(drift, *change)
+		}
+
+		live = append(live, dryRun)
+	}
+
+	return drift, live, nil
+}
+
+// driftMessage lists the drifted objects with the paths of the drifted fields.
+func driftMessage(drift []gitopsv1.ResourceChange) string {
+	var entries []string
+	for _, change := range drift {
+		entry := resourceReferenceString(change.ResourceReference)
+		if change.Action == gitopsv1.ChangeCreate {
+			entry += " (missing)"
+		} else {
+			entry += " (" + strings.Join(change.Fields, ", ") + ")"
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return strings.Join(entries, "; ")
+}
+
+// markDrift records the drift found before a sync, reporting it with an event the first time it is seen or reverted.
+func (r *ApplicationReconciler) markDrift(application *gitopsv1.Application, drift []gitopsv1.ResourceChange, healed bool) {
+	if len(drift) == 0 {
+		application.Status.Drift = nil
+		setCondition(application, gitopsv1.DriftedCondition, metav1.ConditionFalse, gitopsv1.NoDriftReason, "Live objects match the applied revision")
+		return
+	}
+
+	message := driftMessage(drift)
+
+	if healed {
+		application.Status.Drift = nil
+		r.Recorder.Event(application, corev1.EventTypeNormal, gitopsv1.DriftCorrectedReason, "Reverted drift: "+message)
+		setCondition(application, gitopsv1.DriftedCondition, metav1.ConditionFalse, gitopsv1.DriftCorrectedReason, "Reverted drift: "+message)
+		return
+	}
+
+	if previous := meta.FindStatusCondition(application.Status.Conditions, gitopsv1.DriftedCondition); previous == nil || previous.Message != message {
+		r.Recorder.Event(application, corev1.EventTypeWarning, gitopsv1.DriftDetectedReason, "Drift detected: "+message)
+	}
+
+	application.Status.Drift = drift
+	setCondition(application, gitopsv1.DriftedCondition, metav1.ConditionTrue, gitopsv1.DriftDetectedReason, message)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// FinalizerName is the finalizer that keeps an Application around until its objects are torn down
+const FinalizerName = "gitops.potato.io/finalizer"
+
+// deletionPollInterval is how often the termination of the objects of a deleted Application is checked
+const deletionPollInterval = 5 * time.Second
+
+// ensureFinalizer adds FinalizerName to the Application if it is not there yet.
+func (r *ApplicationReconciler) ensureFinalizer(ctx context.Context, application *gitopsv1.Application) error {
+	if controllerutil.ContainsFinalizer(application, FinalizerName) {
+		return nil
+	}
+
+	patch := client.MergeFrom(application.DeepCopy())
+	controllerutil.AddFinalizer(application, FinalizerName)
+
+	return r.Patch(ctx, application, patch)
+}
+
+// finalize tears down the objects of a deleted Application according to its deletion policy and releases the
+// Application once they are gone. Deleted objects are waited for one after the other in reverse apply order. Objects
+// whose kind is not served anymore, e.g. as their CustomResourceDefinition got deleted too, count as gone.
+func (r *ApplicationReconciler) finalize(ctx context.Context, application *gitopsv1.Application, logger logr.Logger) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(application, FinalizerName) {
+		return ctrl.Result{}, nil
+	}
+
+	original := application.DeepCopy()
+
+	var terminating *gitopsv1.ResourceReference
+	var err error
+
+	if application.Spec.DeletionPolicy == gitopsv1.DeletionPolicyOrphan {
+		err = r.orphanResources(ctx, application, application.Status.Inventory, logger)
+	} else {
+		terminating, err = r.deleteResources(ctx, application, logger)
+	}
+
+	if err != nil {
+		logger.Error(err, "Failed to tear down the objects of the Application")
+		r.Recorder.Eventf(application, corev1.EventTypeWarning, gitopsv1.DeletionFailedReason, "Failed to tear down objects: %s", err)
+		markFailed(application, gitopsv1.DeletionFailedReason, err, false)
+
+		if err := r.Status().Patch(ctx, application, client.MergeFrom(original)); err != nil {
+			logger.Error(err, "Failed to update Application status")
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	if terminating != nil {
+		message := "Waiting for " + resourceReferenceString(*terminating) + " to terminate"
+		logger.Info(message)
+
+		setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionFalse, gitopsv1.DeletingReason, message)
+		if err := r.Status().Patch(ctx, application, client.MergeFrom(original)); err != nil {
+			logger.Error(err, "Failed to update Application status")
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{RequeueAfter: deletionPollInterval}, nil
+	}
+
+	logger.Info("Objects of the Application are torn down, removing finalizer")
+
+	patch := client.MergeFrom(application.DeepCopy())
+	controllerutil.RemoveFinalizer(application, FinalizerName)
+	if err := r.Patch(ctx, application, patch); err != nil {
+		logger.Error(err, "Failed to remove finalizer")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// deleteResources deletes the objects in the inventory of the Application in reverse apply order, waiting for each to
+// terminate before deleting the next one. It returns the object that is still terminating, or nil once all are gone.
+// Objects opted out of pruning with PruneAnnotation are orphaned instead.
+func (r *ApplicationReconciler) deleteResources(ctx context.Context, application *gitopsv1.Application, logger logr.Logger) (*gitopsv1.ResourceReference, error) {
+	inventory := application.Status.Inventory
+
+	for i := len(inventory) - 1; i >= 0; i-- {
+		ref := inventory[i]
+
+		object, err := r.getResource(ctx, ref)
+		if resourceGone(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if object.GetAnnotations()[PruneAnnotation] == PruneDisabled {
+			if err := r.orphanResources(ctx, application, []gitopsv1.ResourceReference{ref}, logger); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if object.GetDeletionTimestamp() == nil {
+			logger.Info("Deleting object: " + resourceReferenceString(ref))
+
+			// Foreground deletion keeps the object around until its dependents, e.g. the Pods of a Deployment, are gone
+			propagationPolicy := metav1.DeletePropagationForeground
+			if err := r.Delete(ctx, object, &client.DeleteOptions{PropagationPolicy: &propagationPolicy}); err != nil && !resourceGone(err) {
+				return nil, err
+			}
+
+			r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.DeletedReason, "Deleted %s", resourceReferenceString(ref))
+		}
+
+		// Objects without finalizers or dependents are gone right away
+		if _, err := r.getResource(ctx, ref); resourceGone(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &ref, nil
+	}
+
+	return nil, nil
+}
+
+// orphanResources removes the owner references pointing to the Application from the objects, so the garbage collector
+// leaves them in the cluster when the Application is gone.
+func (r *ApplicationReconciler) orphanResources(ctx context.Context, application *gitopsv1.Application, refs []gitopsv1.ResourceReference, logger logr.Logger) error {
+	for _, ref := range refs {
+		object, err := r.getResource(ctx, ref)
+		if resourceGone(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var ownerReferences []metav1.OwnerReference
+		for _, ownerReference := range object.GetOwnerReferences() {
+			if ownerReference.UID != application.UID {
+				ownerReferences = append(ownerReferences, ownerReference)
+			}
+		}
+
+		if len(ownerReferences) == len(object.GetOwnerReferences()) {
+			continue
+		}
+
+		logger.Info("Orphaning object: " + resourceReferenceString(ref))
+
+		patch := client.MergeFrom(object.DeepCopy())
+		object.SetOwnerReferences(ownerReferences)
+		if err := r.Patch(ctx, object, patch); err != nil {
+			return fmt.Errorf("failed to orphan %s: %w", resourceReferenceString(ref), err)
+		}
+
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.OrphanedReason, "Orphaned %s", resourceReferenceString(ref))
+	}
+
+	return nil
+}
+
+// getResource gets the live object of an inventory entry.
+func (r *ApplicationReconciler) getResource(ctx context.Context, ref gitopsv1.ResourceReference) (*unstructured.Unstructured, error) {
+	object := &unstructured.Unstructured{}
+	object.SetGroupVersionKind(schema.GroupVersionKind{Group: ref.Group, Version: ref.Version, Kind: ref.Kind})
+
+	if err := r.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, object); err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Finalizer", func() {
+	ctx := context.Background()
+
+	var reconciler *ApplicationReconciler
+	var application *gitopsv1.Application
+
+	configMap := func(name string, annotations map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			Annotations:     annotations,
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "gitops.potato.io/v1", Kind: "Application", Name: "cowsay", UID: "cowsay-uid"}},
+		}}
+	}
+
+	BeforeEach(func() {
+		now := metav1.Now()
+		application = &gitopsv1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: "cowsay", Namespace: "default", UID: "cowsay-uid", Finalizers: []string{FinalizerName}, DeletionTimestamp: &now},
+			Status: gitopsv1.ApplicationStatus{Inventory: []gitopsv1.ResourceReference{
+				{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "first"},
+				{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "second"},
+			}},
+		}
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).Should(Succeed())
+		Expect(gitopsv1.AddToScheme(scheme)).Should(Succeed())
+
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		mapper.Add(gitopsv1.GroupVersion.WithKind("Application"), meta.RESTScopeNamespace)
+
+		reconciler = &ApplicationReconciler{
+			Client: fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithObjects(
+				application,
+				configMap("first", nil),
+				configMap("second", map[string]string{PruneAnnotation: PruneDisabled}),
+			).WithStatusSubresource(application).WithInterceptorFuncs(interceptor.Funcs{
+				// Unlike the real client, the fake one does not map the kind before getting an object
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, object client.Object, opts ...client.GetOption) error {
+					groupVersionKind := object.GetObjectKind().GroupVersionKind()
+					if _, err := mapper.RESTMapping(groupVersionKind.GroupKind(), groupVersionKind.Version); groupVersionKind.Kind != "" && err != nil {
+						return err
+					}
+					return c.Get(ctx, key, object, opts...)
+				},
+			}).Build(),
+			Scheme:   scheme,
+			Recorder: record.NewFakeRecorder(10),
+		}
+	})
+
+	Context("When deleting an Application with the Delete policy", func() {
+		It("Should delete its objects and orphan the ones with pruning disabled", func() {
+			result, err := reconciler.finalize(ctx, application, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.RequeueAfter).Should(BeZero())
+
+			err = reconciler.Get(ctx, types.NamespacedName{Namespace: "default", Name: "first"}, &corev1.ConfigMap{})
+			Expect(errors.IsNotFound(err)).Should(BeTrue())
+
+			second := &corev1.ConfigMap{}
+			Expect(reconciler.Get(ctx, types.NamespacedName{Namespace: "default", Name: "second"}, second)).Should(Succeed())
+			Expect(second.OwnerReferences).Should(BeEmpty())
+		})
+	})
+
+	Context("When the kind of an object is not served anymore", func() {
+		It("Should treat the object as gone", func() {
+			// The CustomResourceDefinition of the kind got deleted along with the Application
+			crontab := gitopsv1.ResourceReference{Group: "stable.example.com", Version: "v1", Kind: "CronTab", Namespace: "default", Name: "backup"}
+			application.Status.Inventory = append([]gitopsv1.ResourceReference{crontab}, application.Status.Inventory...)
+
+			result, err := reconciler.finalize(ctx, application, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.RequeueAfter).Should(BeZero())
+			Expect(application.Finalizers).ShouldNot(ContainElement(FinalizerName))
+
+			application.Spec.DeletionPolicy = gitopsv1.DeletionPolicyOrphan
+			Expect(reconciler.orphanResources(ctx, application, []gitopsv1.ResourceReference{crontab}, logf.Log)).Should(Succeed())
+		})
+	})
+
+	Context("When deleting an Application with the Orphan policy", func() {
+		It("Should keep its objects without the owner reference", func() {
+			application.Spec.DeletionPolicy = gitopsv1.DeletionPolicyOrphan
+
+			_, err := reconciler.finalize(ctx, application, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			first := &corev1.ConfigMap{}
+			Expect(reconciler.Get(ctx, types.NamespacedName{Namespace: "default", Name: "first"}, first)).Should(Succeed())
+			Expect(first.OwnerReferences).Should(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,181 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// syncRepository brings the cached mirror of the repository of the Application up to date, resolves the ref of the
+// Application in it and exports the files of the resulting commit to the worktree of the Application. It returns the
+// commit SHA and the worktree. Branches follow force pushes, tags and semver ranges resolve to the commit of the tag.
+// Unless a fetch is due, the revision checked out last is used without contacting the remote.
+func (r *ApplicationReconciler) syncRepository(ctx context.Context, application *gitopsv1.Application, logger logr.Logger) (string, string, error) {
+	ref := application.Spec.Ref
+	if ref.String() == "" {
+		return "", "", fmt.Errorf("ref has to set one of branch, tag, semver or commit")
+	}
+
+	_, triggered := r.triggered.LoadAndDelete(client.ObjectKeyFromObject(application))
+
+	if !r.fetchDue(application, triggered) {
+		revision := application.Status.LastAttemptedRevision
+		if worktree, ok := r.Cache.Worktree(application, revision); ok {
+			logger.Info("Fetch not due yet, using checked out revision: " + revision)
+			return revision, worktree, nil
+		}
+	}
+
+	auth, err := r.authMethod(ctx, application)
+	if err != nil {
+		logger.Error(err, "Failed to set up authentication for repository...")
+		return "", "", err
+	}
+
+	resolve := func(repository *git.Repository) (plumbing.Hash, error) {
+		return resolveRef(repository, ref, logger)
+	}
+
+	revision, worktree, cloned, err := r.Cache.Checkout(ctx, application, auth, resolve, logger)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := metav1.Now()
+	application.Status.LastFetchTime = &now
+
+	if cloned {
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.ClonedReason, "Cloned %s at revision %s", application.Spec.Repository, revision)
+	}
+
+	return revision, worktree, nil
+}
+
+// resolveRef returns the commit ref points to in the mirror of a repository.
+func resolveRef(repository *git.Repository, ref *gitopsv1.GitReference, logger logr.Logger) (plumbing.Hash, error) {
+	switch {
+	case ref.Branch != "":
+		reference, err := repository.Reference(plumbing.NewBranchReferenceName(ref.Branch), true)
+		if err != nil {
+			logger.Error(err, "Failed to resolve branch: "+ref.Branch)
+			return plumbing.ZeroHash, fmt.Errorf("branch %s not found in repository: %w", ref.Branch, err)
+		}
+
+		return reference.Hash(), nil
+	case ref.Tag != "":
+		hash, err := tagCommit(repository, plumbing.NewTagReferenceName(ref.Tag))
+		if err != nil {
+			logger.Error(err, "Failed to resolve tag: "+ref.Tag)
+			return plumbing.ZeroHash, fmt.Errorf("tag %s not found in repository: %w", ref.Tag, err)
+		}
+
+		return hash, nil
+	case ref.SemVer != "":
+		tagReferences, err := repository.Tags()
+		if err != nil {
+			logger.Error(err, "Failed to list tags...")
+			return plumbing.ZeroHash, err
+		}
+
+		var tags []string
+		_ = tagReferences.ForEach(func(reference *plumbing.Reference) error {
+			tags = append(tags, reference.Name().Short())
+			return nil
+		})
+
+		tag, err := highestMatchingTag(tags, ref.SemVer)
+		if err != nil {
+			logger.Error(err, "Failed to select a tag for: "+ref.SemVer)
+			return plumbing.ZeroHash, err
+		}
+
+		logger.Info("Selected tag: " + tag + " for: " + ref.SemVer)
+
+		return tagCommit(repository, plumbing.NewTagReferenceName(tag))
+	}
+
+	hash := plumbing.NewHash(ref.Commit)
+	if _, err := repository.CommitObject(hash); err != nil {
+		logger.Error(err, "Failed to find commit: "+ref.Commit)
+		return plumbing.ZeroHash, fmt.Errorf("commit %s not found in repository: %w", ref.Commit, err)
+	}
+
+	return hash, nil
+}
+
+// tagCommit returns the commit a tag points to, peeling annotated tags.
+func tagCommit(repository *git.Repository, tagReference plumbing.ReferenceName) (plumbing.Hash, error) {
+	reference, err := repository.Reference(tagReference, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	tag, err := repository.TagObject(reference.Hash())
+	if err == plumbing.ErrObjectNotFound {
+		// Lightweight tags point to the commit directly
+		return reference.Hash(), nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	commit, err := tag.Commit()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return commit.Hash, nil
+}
+
+// highestMatchingTag returns the tag with the highest semantic version that satisfies semverRange. Tags that are not
+// semantic versions are ignored, a leading `v` is allowed.
+func highestMatchingTag(tags []string, semverRange string) (string, error) {
+	constraint, err := semver.NewConstraint(semverRange)
+	if err != nil {
+		return "", fmt.Errorf("invalid semver range %s: %w", semverRange, err)
+	}
+
+	var highestTag string
+	var highestVersion *semver.Version
+
+	for _, tag := range tags {
+		version, err := semver.NewVersion(tag)
+		if err != nil {
+			continue
+		}
+
+		if constraint.Check(version) && (highestVersion == nil || version.GreaterThan(highestVersion)) {
+			highestTag = tag
+			highestVersion = version
+		}
+	}
+
+	if highestVersion == nil {
+		return "", fmt.Errorf("no tag matches semver range %s", semverRange)
+	}
+
+	return highestTag, nil
+}
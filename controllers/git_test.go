@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Git references", func() {
+	Context("When selecting a tag for a semver range", func() {
+		tags := []string{"v1.0.0", "v1.2.0", "1.3.1", "v2.0.0", "latest", "v1.4.0-rc.1"}
+
+		It("Should pick the highest matching version", func() {
+			Expect(highestMatchingTag(tags, ">=1.2.0 <2.0.0")).Should(Equal("1.3.1"))
+		})
+
+		It("Should fail if no tag matches", func() {
+			_, err := highestMatchingTag(tags, ">=3.0.0")
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("Should fail for an invalid range", func() {
+			_, err := highestMatchingTag(tags, "not a range")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
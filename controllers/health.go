@@ -0,0 +1,347 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// DefaultHealthTimeout is how long objects may take to become healthy if the Application does not say otherwise
+const DefaultHealthTimeout = 5 * time.Minute
+
+// assessHealth returns the health of an applied object along with a message if it is not healthy. Well-known workload
+// kinds get dedicated checks, everything else is judged by its status conditions the way kstatus does.
+func assessHealth(object *unstructured.Unstructured) (string, string) {
+	var health, message string
+	var err error
+
+	switch object.GroupVersionKind().GroupKind() {
+	case schema.GroupKind{Group: "apps", Kind: "Deployment"}:
+		health, message, err = deploymentHealth(object)
+	case schema.GroupKind{Group: "apps", Kind: "StatefulSet"}:
+		health, message, err = statefulSetHealth(object)
+	case schema.GroupKind{Group: "apps", Kind: "DaemonSet"}:
+		health, message, err = daemonSetHealth(object)
+	case schema.GroupKind{Group: "batch", Kind: "Job"}:
+		health, message, err = jobHealth(object)
+	case schema.GroupKind{Kind: "PersistentVolumeClaim"}:
+		health, message, err = persistentVolumeClaimHealth(object)
+	case schema.GroupKind{Kind: "Service"}:
+		health, message = serviceHealth(object)
+	case schema.GroupKind{Group: "networking.k8s.io", Kind: "Ingress"}:
+		health, message = loadBalancerHealth(object)
+	default:
+		health, message = genericHealth(object)
+	}
+
+	if err != nil {
+		return gitopsv1.HealthUnknown, "Failed to assess health: " + err.Error()
+	}
+
+	return health, message
+}
+
+// observedGenerationHealth reports an object as progressing while its controller did not catch up with its spec yet.
+func observedGenerationHealth(object *unstructured.Unstructured, observedGeneration int64) (string, string, bool) {
+	if observedGeneration < object.GetGeneration() {
+		return gitopsv1.HealthProgressing, "Waiting for the controller to observe the latest generation", false
+	}
+
+	return "", "", true
+}
+
+func deploymentHealth(object *unstructured.Unstructured) (string, string, error) {
+	deployment := &appsv1.Deployment{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, deployment); err != nil {
+		return "", "", err
+	}
+
+	if health, message, ok := observedGenerationHealth(object, deployment.Status.ObservedGeneration); !ok {
+		return health, message, nil
+	}
+
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return gitopsv1.HealthDegraded, "Rollout exceeded its progress deadline: " + condition.Message, nil
+		}
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	status := deployment.Status
+	switch {
+	case status.UpdatedReplicas < replicas:
+		return gitopsv1.HealthProgressing, fmt.Sprintf("%d of %d replicas updated", status.UpdatedReplicas, replicas), nil
+	case status.Replicas > status.UpdatedReplicas:
+		return gitopsv1.HealthProgressing, fmt.Sprintf("%d old replicas pending termination", status.Replicas-status.UpdatedReplicas), nil
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		return gitopsv1.HealthProgressing, fmt.Sprintf("%d of %d updated replicas available", status.AvailableReplicas, status.UpdatedReplicas), nil
+	}
+
+	return gitopsv1.HealthHealthy, "", nil
+}
+
+func statefulSetHealth(object *unstructured.Unstructured) (string, string, error) {
+	statefulSet := &appsv1.StatefulSet{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, statefulSet); err != nil {
+		return "", "", err
+	}
+
+	if health, message, ok := observedGenerationHealth(object, statefulSet.Status.ObservedGeneration); !ok {
+		return health, message, nil
+	}
+
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+
+	status := statefulSet.Status
+	if status.ReadyReplicas < replicas {
+		return gitopsv1.HealthProgressing, fmt.Sprintf("%d of %d replicas ready", status.ReadyReplicas, replicas), nil
+	}
+
+	// Pods are only replaced by hand with OnDelete, there is no rollout to wait for
+	if statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return gitopsv1.HealthHealthy, "", nil
+	}
+
+	partition := int32(0)
+	if rollingUpdate := statefulSet.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil {
+		partition = *rollingUpdate.Partition
+	}
+
+	if partition > 0 {
+		if expected := replicas - partition; status.UpdatedReplicas < expected {
+			return gitopsv1.HealthProgressing, fmt.Sprintf("%d of %d replicas above the partition updated", status.UpdatedReplicas, expected), nil
+		}
+	} else if status.UpdateRevision != status.CurrentRevision {
+		return gitopsv1.HealthProgressing, fmt.Sprintf("Rolling out revision %s, %d of %d replicas updated", status.UpdateRevision, status.UpdatedReplicas, replicas), nil
+	}
+
+	return gitopsv1.HealthHealthy, "", nil
+}
+
+func daemonSetHealth(object *unstructured.Unstructured) (string, string, error) {
+	daemonSet := &appsv1.DaemonSet{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, daemonSet); err != nil {
+		return "", "", err
+	}
+
+	if health, message, ok := observedGenerationHealth(object, daemonSet.Status.ObservedGeneration); !ok {
+		return health, message, nil
+	}
+
+	status := daemonSet.Status
+	switch {
+	case status.UpdatedNumberScheduled < status.DesiredNumberScheduled:
+		return gitopsv1.HealthProgressing, fmt.Sprintf("%d of %d pods updated", status.UpdatedNumberScheduled, status.DesiredNumberScheduled), nil
+	case status.NumberAvailable < status.DesiredNumberScheduled:
+		return gitopsv1.HealthProgressing, fmt.Sprintf("%d of %d pods available", status.NumberAvailable, status.DesiredNumberScheduled), nil
+	}
+
+	return gitopsv1.HealthHealthy, "", nil
+}
+
+func jobHealth(object *unstructured.Unstructured) (string, string, error) {
+	job := &batchv1.Job{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, job); err != nil {
+		return "", "", err
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch condition.Type {
+		case batchv1.JobFailed:
+			return gitopsv1.HealthDegraded, "Job failed: " + condition.Message, nil
+		case batchv1.JobComplete:
+			return gitopsv1.HealthHealthy, "", nil
+		}
+	}
+
+	return gitopsv1.HealthProgressing, fmt.Sprintf("Job is running, %d active and %d succeeded pods", job.Status.Active, job.Status.Succeeded), nil
+}
+
+func persistentVolumeClaimHealth(object *unstructured.Unstructured) (string, string, error) {
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, claim); err != nil {
+		return "", "", err
+	}
+
+	switch claim.Status.Phase {
+	case corev1.ClaimBound:
+		return gitopsv1.HealthHealthy, "", nil
+	case corev1.ClaimLost:
+		return gitopsv1.HealthDegraded, "Claim lost its volume", nil
+	}
+
+	return gitopsv1.HealthProgressing, "Waiting for the claim to be bound", nil
+}
+
+func serviceHealth(object *unstructured.Unstructured) (string, string) {
+	serviceType, _, _ := unstructured.NestedString(object.Object, "spec", "type")
+	if serviceType != string(corev1.ServiceTypeLoadBalancer) {
+		return gitopsv1.HealthHealthy, ""
+	}
+
+	return loadBalancerHealth(object)
+}
+
+// loadBalancerHealth reports Services of type LoadBalancer and Ingresses as progressing until they got an address.
+func loadBalancerHealth(object *unstructured.Unstructured) (string, string) {
+	ingress, _, _ := unstructured.NestedSlice(object.Object, "status", "loadBalancer", "ingress")
+	if len(ingress) == 0 {
+		return gitopsv1.HealthProgressing, "Waiting for a load balancer address"
+	}
+
+	return gitopsv1.HealthHealthy, ""
+}
+
+// genericHealth judges objects by the conventions of kstatus: an outdated status.observedGeneration or a True
+// Reconciling condition mean progressing, a True Stalled condition means degraded and a Ready condition is taken at its
+// word. Objects without any of these, e.g. ConfigMaps, are healthy as soon as they exist.
+func genericHealth(object *unstructured.Unstructured) (string, string) {
+	observedGeneration, found, _ := unstructured.NestedInt64(object.Object, "status", "observedGeneration")
+	if found {
+		if health, message, ok := observedGenerationHealth(object, observedGeneration); !ok {
+			return health, message
+		}
+	}
+
+	rawConditions, _, _ := unstructured.NestedSlice(object.Object, "status", "conditions")
+
+	conditions := map[string]metav1.Condition{}
+	for _, rawCondition := range rawConditions {
+		fields, ok := rawCondition.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		conditionType, _, _ := unstructured.NestedString(fields, "type")
+		status, _, _ := unstructured.NestedString(fields, "status")
+		message, _, _ := unstructured.NestedString(fields, "message")
+
+		conditions[conditionType] = metav1.Condition{Type: conditionType, Status: metav1.ConditionStatus(status), Message: message}
+	}
+
+	if condition, ok := conditions["Stalled"]; ok && condition.Status == metav1.ConditionTrue {
+		return gitopsv1.HealthDegraded, condition.Message
+	}
+
+	if condition, ok := conditions["Reconciling"]; ok && condition.Status == metav1.ConditionTrue {
+		return gitopsv1.HealthProgressing, condition.Message
+	}
+
+	if condition, ok := conditions["Ready"]; ok {
+		switch condition.Status {
+		case metav1.ConditionTrue:
+			return gitopsv1.HealthHealthy, ""
+		case metav1.ConditionFalse:
+			return gitopsv1.HealthDegraded, condition.Message
+		default:
+			return gitopsv1.HealthProgressing, condition.Message
+		}
+	}
+
+	return gitopsv1.HealthHealthy, ""
+}
+
+// aggregateHealth combines the health of the applied objects: any degraded object degrades the Application, otherwise
+// any object that is not healthy yet keeps it progressing.
+func aggregateHealth(resources []gitopsv1.ResourceStatus) (string, string) {
+	health := gitopsv1.HealthHealthy
+	message := ""
+
+	for _, resource := range resources {
+		if resource.Health == gitopsv1.HealthHealthy {
+			continue
+		}
+
+		current := resourceReferenceString(resource.ResourceReference) + ": " + resource.HealthMessage
+
+		if resource.Health == gitopsv1.HealthDegraded {
+			if health != gitopsv1.HealthDegraded {
+				health, message = gitopsv1.HealthDegraded, current
+			}
+		} else if health == gitopsv1.HealthHealthy {
+			health, message = gitopsv1.HealthProgressing, current
+		}
+	}
+
+	return health, message
+}
+
+// checkHealth records the health of the objects of the last sync in the Healthy condition and emits an event when it
+// changes. The health timeout starts over if the sync changed any of the objects.
+func (r *ApplicationReconciler) checkHealth(application *gitopsv1.Application, revision string, resources []gitopsv1.ResourceStatus, changed bool, logger logr.Logger) {
+	if changed || application.Status.LastChangeTime == nil {
+		now := metav1.Now()
+		application.Status.LastChangeTime = &now
+	}
+
+	// Copied, as setting the condition updates it in place
+	var previous *metav1.Condition
+	if condition := meta.FindStatusCondition(application.Status.Conditions, gitopsv1.HealthyCondition); condition != nil {
+		previous = condition.DeepCopy()
+	}
+
+	health, message := aggregateHealth(resources)
+	logger.Info("Health of the applied objects: " + health)
+	markHealth(application, health, message, healthTimeout(application))
+
+	current := meta.FindStatusCondition(application.Status.Conditions, gitopsv1.HealthyCondition)
+	if previous != nil && previous.Status == current.Status && previous.Reason == current.Reason {
+		return
+	}
+
+	switch current.Status {
+	case metav1.ConditionTrue:
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, current.Reason, "Healthy at revision %s", revision)
+	case metav1.ConditionFalse:
+		r.Recorder.Eventf(application, corev1.EventTypeWarning, current.Reason, "Unhealthy at revision %s: %s", revision, current.Message)
+	default:
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, current.Reason, "Waiting for objects to become healthy at revision %s: %s", revision, current.Message)
+	}
+}
+
+// healthTimeout returns how long the objects of the Application may take to become healthy.
+func healthTimeout(application *gitopsv1.Application) time.Duration {
+	if application.Spec.HealthTimeout == nil {
+		return DefaultHealthTimeout
+	}
+
+	return application.Spec.HealthTimeout.Duration
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Health assessment", func() {
+	deployment := func(generation int64, status map[string]interface{}) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "cowsay", "namespace": "default", "generation": generation},
+			"spec":       map[string]interface{}{"replicas": int64(2)},
+			"status":     status,
+		}}
+
+		return object
+	}
+
+	Context("When assessing a Deployment", func() {
+		It("Should be progressing until the rollout is observed", func() {
+			health, _ := assessHealth(deployment(2, map[string]interface{}{"observedGeneration": int64(1)}))
+
+			Expect(health).Should(Equal(gitopsv1.HealthProgressing))
+		})
+
+		It("Should be progressing until all replicas are available", func() {
+			health, message := assessHealth(deployment(1, map[string]interface{}{
+				"observedGeneration": int64(1), "replicas": int64(2), "updatedReplicas": int64(2), "availableReplicas": int64(1),
+			}))
+
+			Expect(health).Should(Equal(gitopsv1.HealthProgressing))
+			Expect(message).Should(Equal("1 of 2 updated replicas available"))
+		})
+
+		It("Should be healthy once all replicas are available", func() {
+			health, _ := assessHealth(deployment(1, map[string]interface{}{
+				"observedGeneration": int64(1), "replicas": int64(2), "updatedReplicas": int64(2), "availableReplicas": int64(2),
+			}))
+
+			Expect(health).Should(Equal(gitopsv1.HealthHealthy))
+		})
+
+		It("Should be degraded when the progress deadline is exceeded", func() {
+			health, _ := assessHealth(deployment(1, map[string]interface{}{
+				"observedGeneration": int64(1),
+				"conditions": []interface{}{
+					map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"},
+				},
+			}))
+
+			Expect(health).Should(Equal(gitopsv1.HealthDegraded))
+		})
+	})
+
+	Context("When assessing a custom resource", func() {
+		It("Should follow its Ready condition", func() {
+			object := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Database",
+				"metadata":   map[string]interface{}{"name": "cowsay"},
+				"status": map[string]interface{}{
+					"conditions": []interface{}{
+						map[string]interface{}{"type": "Ready", "status": "False", "message": "disk full"},
+					},
+				},
+			}}
+
+			health, message := assessHealth(object)
+
+			Expect(health).Should(Equal(gitopsv1.HealthDegraded))
+			Expect(message).Should(Equal("disk full"))
+		})
+
+		It("Should be healthy without any status", func() {
+			object := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"name": "cowsay"},
+			}}
+
+			health, _ := assessHealth(object)
+
+			Expect(health).Should(Equal(gitopsv1.HealthHealthy))
+		})
+	})
+
+	Context("When aggregating the health of the applied objects", func() {
+		It("Should report the first degraded object over progressing ones", func() {
+			resources := []gitopsv1.ResourceStatus{
+				{ResourceReference: gitopsv1.ResourceReference{Kind: "Service", Namespace: "default", Name: "cowsay"}, Health: gitopsv1.HealthProgressing},
+				{ResourceReference: gitopsv1.ResourceReference{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "cowsay"}, Health: gitopsv1.HealthDegraded, HealthMessage: "failed"},
+			}
+
+			health, message := aggregateHealth(resources)
+
+			Expect(health).Should(Equal(gitopsv1.HealthDegraded))
+			Expect(message).Should(Equal("Deployment.apps default/cowsay: failed"))
+		})
+	})
+})
@@ -0,0 +1,324 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// DefaultValuesKey is the key of a Secret or ConfigMap holding Helm values if none is given
+const DefaultValuesKey = "values.yaml"
+
+// renderHelmChart renders the Helm chart of the Application in chartDir and returns the manifests as a YAML stream,
+// with the CRDs of the chart first. Helm hooks are not part of the result. The rendered release is recorded in the
+// status of the Application, its revision is incremented whenever the chart or its values change.
+func (r *ApplicationReconciler) renderHelmChart(ctx context.Context, application *gitopsv1.Application, repositoryPath string, chartDir string, logger logr.Logger) ([]byte, error) {
+	helm := application.Spec.Helm
+
+	helmChart, err := loader.Load(chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chart: %w", err)
+	}
+
+	capabilities, err := r.helmCapabilities()
+	if err != nil {
+		return nil, err
+	}
+
+	if kubeVersion := helmChart.Metadata.KubeVersion; kubeVersion != "" && !chartutil.IsCompatibleRange(kubeVersion, capabilities.KubeVersion.String()) {
+		return nil, fmt.Errorf("chart requires kubeVersion %s, which is incompatible with Kubernetes %s", kubeVersion, capabilities.KubeVersion.String())
+	}
+
+	values, err := r.helmValues(ctx, application, repositoryPath, chartDir)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := helmDigest(helmChart.Raw, values)
+	if err != nil {
+		return nil, err
+	}
+
+	release := &gitopsv1.HelmReleaseStatus{
+		ReleaseName:  helm.ReleaseName,
+		ChartName:    helmChart.Name(),
+		ChartVersion: helmChart.Metadata.Version,
+		Revision:     1,
+		Digest:       digest,
+	}
+
+	if release.ReleaseName == "" {
+		release.ReleaseName = application.Name
+	}
+
+	if previous := application.Status.Helm; previous != nil {
+		release.Revision = previous.Revision
+
+		if previous.Digest != digest || previous.ReleaseName != release.ReleaseName {
+			release.Revision++
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Rendering chart %s-%s as release %s revision %d", release.ChartName, release.ChartVersion, release.ReleaseName, release.Revision))
+
+	renderValues, err := chartutil.ToRenderValues(helmChart, values, chartutil.ReleaseOptions{
+		Name:      release.ReleaseName,
+		Namespace: releaseNamespace(application),
+		Revision:  release.Revision,
+		IsInstall: release.Revision == 1,
+		IsUpgrade: release.Revision > 1,
+	}, capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compose values: %w", err)
+	}
+
+	files, err := engine.Render(helmChart, renderValues)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render chart: %w", err)
+	}
+
+	hooks, manifests, err := releaseutil.SortManifests(files, capabilities.APIVersions, releaseutil.InstallOrder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split rendered chart: %w", err)
+	}
+
+	if len(hooks) > 0 {
+		logger.Info(fmt.Sprintf("Skipping %d Helm hooks of the chart", len(hooks)))
+	}
+
+	var stream bytes.Buffer
+
+	for _, crd := range helmChart.CRDObjects() {
+		fmt.Fprintf(&stream, "---\n# Source: %s\n%s\n", crd.Filename, crd.File.Data)
+	}
+
+	for _, manifest := range manifests {
+		fmt.Fprintf(&stream, "---\n# Source: %s\n%s\n", manifest.Name, manifest.Content)
+	}
+
+	application.Status.Helm = release
+
+	return stream.Bytes(), nil
+}
+
+// helmCapabilities describes the cluster to the chart the way Helm does, with the version of the API server and the API
+// versions it serves, so charts checking .Capabilities render for the cluster they are applied to. The API versions are
+// discovered on every render, as CRDs installed by other Applications add new ones.
+func (r *ApplicationReconciler) helmCapabilities() (*chartutil.Capabilities, error) {
+	if r.Discovery == nil {
+		return chartutil.DefaultCapabilities, nil
+	}
+
+	kubeVersion, err := r.Discovery.ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the Kubernetes version: %w", err)
+	}
+
+	// Groups that cannot be discovered, e.g. of unavailable API services, are left out
+	groups, resources, err := r.Discovery.ServerGroupsAndResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, fmt.Errorf("failed to get the API versions: %w", err)
+	}
+
+	return &chartutil.Capabilities{
+		KubeVersion: chartutil.KubeVersion{Version: kubeVersion.GitVersion, Major: kubeVersion.Major, Minor: kubeVersion.Minor},
+		APIVersions: helmVersionSet(groups, resources),
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}, nil
+}
+
+// helmVersionSet lists the served group versions and the kinds of every group version, e.g. `apps/v1` and
+// `apps/v1/Deployment`, which is what .Capabilities.APIVersions.Has of a chart is checked against.
+func helmVersionSet(groups []*metav1.APIGroup, resources []*metav1.APIResourceList) chartutil.VersionSet {
+	seen := map[string]bool{}
+	var versions []string
+
+	add := func(version string) {
+		if !seen[version] {
+			seen[version] = true
+			versions = append(versions, version)
+		}
+	}
+
+	for _, group := range groups {
+		for _, version := range group.Versions {
+			add(version.GroupVersion)
+		}
+	}
+
+	for _, list := range resources {
+		for _, resource := range list.APIResources {
+			add(path.Join(list.GroupVersion, resource.Kind))
+		}
+	}
+
+	return versions
+}
+
+// helmValues merges the values of the Application in order: ValuesFiles relative to chartDir, ValuesFrom and the inline
+// Values. The default values of the chart are merged in by Helm when rendering.
+func (r *ApplicationReconciler) helmValues(ctx context.Context, application *gitopsv1.Application, repositoryPath string, chartDir string) (map[string]interface{}, error) {
+	helm := application.Spec.Helm
+	values := map[string]interface{}{}
+
+	for _, valuesFile := range helm.ValuesFiles {
+		valuesPath := filepath.Join(chartDir, valuesFile)
+		if !strings.HasPrefix(valuesPath, filepath.Clean(repositoryPath)+string(filepath.Separator)) {
+			return nil, fmt.Errorf("values file %s points outside of the repository", valuesFile)
+		}
+
+		fileValues, err := chartutil.ReadValuesFile(valuesPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values file %s: %w", valuesFile, err)
+		}
+
+		mergeValues(values, fileValues)
+	}
+
+	for _, reference := range helm.ValuesFrom {
+		data, err := r.referencedValues(ctx, application.Namespace, reference)
+		if err != nil {
+			return nil, err
+		}
+
+		if data == nil {
+			continue
+		}
+
+		referencedValues, err := chartutil.ReadValues(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values of %s %s: %w", reference.Kind, reference.Name, err)
+		}
+
+		mergeValues(values, referencedValues)
+	}
+
+	if helm.Values != nil && len(helm.Values.Raw) > 0 {
+		inlineValues := map[string]interface{}{}
+		if err := json.Unmarshal(helm.Values.Raw, &inlineValues); err != nil {
+			return nil, fmt.Errorf("failed to read inline values: %w", err)
+		}
+
+		mergeValues(values, inlineValues)
+	}
+
+	return values, nil
+}
+
+// referencedValues returns the content of the key of the referenced Secret or ConfigMap, or nil if an optional
+// reference cannot be resolved.
+func (r *ApplicationReconciler) referencedValues(ctx context.Context, namespace string, reference gitopsv1.ValuesReference) ([]byte, error) {
+	key := reference.ValuesKey
+	if key == "" {
+		key = DefaultValuesKey
+	}
+
+	name := types.NamespacedName{Namespace: namespace, Name: reference.Name}
+
+	var data []byte
+	var found bool
+	var err error
+
+	switch reference.Kind {
+	case "Secret":
+		secret := &corev1.Secret{}
+		if err = r.Get(ctx, name, secret); err == nil {
+			data, found = secret.Data[key]
+		}
+	case "ConfigMap":
+		configMap := &corev1.ConfigMap{}
+		if err = r.Get(ctx, name, configMap); err == nil {
+			var value string
+			value, found = configMap.Data[key]
+			data = []byte(value)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported kind %s for values of %s", reference.Kind, reference.Name)
+	}
+
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get values from %s %s: %w", reference.Kind, name, err)
+	}
+
+	if err != nil || !found {
+		if reference.Optional {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("values key %s of %s %s not found", key, reference.Kind, name)
+	}
+
+	return data, nil
+}
+
+// mergeValues deep merges src into dst, values of src take precedence.
+func mergeValues(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcTable, srcIsTable := value.(map[string]interface{})
+		dstTable, dstIsTable := dst[key].(map[string]interface{})
+
+		if srcIsTable && dstIsTable {
+			mergeValues(dstTable, srcTable)
+			continue
+		}
+
+		dst[key] = value
+	}
+}
+
+// helmDigest returns a digest of the chart files and the values it is rendered with.
+func helmDigest(files []*chart.File, values map[string]interface{}) (string, error) {
+	hash := sha256.New()
+
+	sorted := append([]*chart.File{}, files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	for _, file := range sorted {
+		fmt.Fprintf(hash, "%s\n%d\n", file.Name, len(file.Data))
+		hash.Write(file.Data)
+	}
+
+	// Maps are marshalled with sorted keys, so the digest is stable
+	encodedValues, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	hash.Write(encodedValues)
+
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Helm", func() {
+	ctx := context.Background()
+
+	var repository, chartDir string
+	var reconciler *ApplicationReconciler
+	var application *gitopsv1.Application
+
+	write := func(file, content string) {
+		Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+		Expect(os.WriteFile(file, []byte(content), 0644)).To(Succeed())
+	}
+
+	// render returns the data of the ConfigMap rendered by the chart
+	render := func() map[string]string {
+		rendered, err := reconciler.renderHelmChart(ctx, application, repository, chartDir, logf.Log)
+		Expect(err).NotTo(HaveOccurred())
+
+		configMap := &corev1.ConfigMap{}
+		Expect(yaml.Unmarshal(rendered, configMap)).To(Succeed())
+		return configMap.Data
+	}
+
+	BeforeEach(func() {
+		var err error
+		repository, err = os.MkdirTemp("", "helm")
+		Expect(err).NotTo(HaveOccurred())
+
+		chartDir = filepath.Join(repository, "chart")
+		write(filepath.Join(chartDir, "Chart.yaml"), "apiVersion: v2\nname: cowsay\nversion: 1.0.0\nkubeVersion: \">= 1.22.0-0\"\n")
+		write(filepath.Join(chartDir, "values.yaml"), "defaults: chart\nfile: chart\nreference: chart\ninline: chart\n")
+		write(filepath.Join(chartDir, "values-prod.yaml"), "file: file\nreference: file\ninline: file\n")
+		write(filepath.Join(chartDir, "templates", "configmap.yaml"), `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cowsay
+data:
+  defaults: {{ .Values.defaults }}
+  file: {{ .Values.file }}
+  reference: {{ .Values.reference }}
+  inline: {{ .Values.inline }}
+  kubeVersion: {{ .Capabilities.KubeVersion.Version }}
+  certManager: {{ .Capabilities.APIVersions.Has "cert-manager.io/v1/Certificate" | quote }}
+`)
+
+		application = &gitopsv1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: "cowsay", Namespace: "default"},
+			Spec: gitopsv1.ApplicationSpec{Helm: &gitopsv1.HelmSpec{
+				ValuesFiles: []string{"values-prod.yaml"},
+				ValuesFrom: []gitopsv1.ValuesReference{
+					{Kind: "ConfigMap", Name: "cowsay-values"},
+					{Kind: "Secret", Name: "missing", Optional: true},
+				},
+				Values: &apiextensionsv1.JSON{Raw: []byte(`{"inline": "inline"}`)},
+			}},
+		}
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).Should(Succeed())
+
+		discovery := &fakediscovery.FakeDiscovery{
+			Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{
+				{GroupVersion: "cert-manager.io/v1", APIResources: []metav1.APIResource{{Name: "certificates", Kind: "Certificate"}}},
+			}},
+			FakedServerVersion: &version.Info{GitVersion: "v1.29.0", Major: "1", Minor: "29"},
+		}
+
+		reconciler = &ApplicationReconciler{
+			Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "cowsay-values", Namespace: "default"},
+				Data:       map[string]string{DefaultValuesKey: "reference: reference\ninline: reference\n"},
+			}).Build(),
+			Scheme:    scheme,
+			Discovery: discovery,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(repository)).To(Succeed())
+	})
+
+	It("Should merge the chart defaults, values files, referenced values and inline values in order", func() {
+		data := render()
+
+		Expect(data).Should(HaveKeyWithValue("defaults", "chart"))
+		Expect(data).Should(HaveKeyWithValue("file", "file"))
+		Expect(data).Should(HaveKeyWithValue("reference", "reference"))
+		Expect(data).Should(HaveKeyWithValue("inline", "inline"))
+	})
+
+	It("Should fail on missing values references unless they are optional", func() {
+		application.Spec.Helm.ValuesFrom[1].Optional = false
+
+		_, err := reconciler.renderHelmChart(ctx, application, repository, chartDir, logf.Log)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("Should not read values files outside of the repository", func() {
+		application.Spec.Helm.ValuesFiles = []string{"../../etc/passwd"}
+
+		_, err := reconciler.renderHelmChart(ctx, application, repository, chartDir, logf.Log)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("Should render for the version and the API versions of the cluster", func() {
+		data := render()
+
+		Expect(data).Should(HaveKeyWithValue("kubeVersion", "v1.29.0"))
+		Expect(data).Should(HaveKeyWithValue("certManager", "true"))
+	})
+
+	It("Should refuse charts that do not support the version of the cluster", func() {
+		reconciler.Discovery.(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: "v1.21.0", Major: "1", Minor: "21"}
+
+		_, err := reconciler.renderHelmChart(ctx, application, repository, chartDir, logf.Log)
+		Expect(err).Should(MatchError(ContainSubstring("kubeVersion")))
+	})
+
+	It("Should only increment the release revision when the values change", func() {
+		render()
+		Expect(application.Status.Helm.Revision).Should(Equal(1))
+
+		render()
+		Expect(application.Status.Helm.Revision).Should(Equal(1))
+
+		application.Spec.Helm.Values = &apiextensionsv1.JSON{Raw: []byte(`{"inline": "changed"}`)}
+		Expect(render()).Should(HaveKeyWithValue("inline", "changed"))
+		Expect(application.Status.Helm.Revision).Should(Equal(2))
+	})
+})
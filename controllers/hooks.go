@@ -0,0 +1,359 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// HookAnnotation turns a manifest into a hook that runs in a phase of the sync, PreSync, PostSync or SyncFail, instead
+// of being applied with the other manifests
+const HookAnnotation = "gitops.potato.io/hook"
+
+// HookDeletePolicyAnnotation lists when a hook is deleted, separated by commas, defaults to HookDeleteBeforeCreation
+const HookDeletePolicyAnnotation = "gitops.potato.io/hook-delete-policy"
+
+// HookRevisionAnnotation is set on hooks to the revision they run for
+const HookRevisionAnnotation = "gitops.potato.io/hook-revision"
+
+// Delete policies of hooks
+const (
+	// HookDeleteBeforeCreation deletes the hook of a previous run before running it again
+	HookDeleteBeforeCreation = "BeforeHookCreation"
+	// HookDeleteSucceeded deletes the hook once it succeeded
+	HookDeleteSucceeded = "HookSucceeded"
+)
+
+type FailedToRunHook struct {
+	Phase string
+	Hook  string
+	Err   error
+}
+
+func (e *FailedToRunHook) Error() string {
+	return fmt.Sprintf("%s hook %s failed: %s", e.Phase, e.Hook, e.Err)
+}
+
+func (e *FailedToRunHook) Unwrap() error {
+	return e.Err
+}
+
+// splitHooks separates the hooks from the manifests applied by the sync, grouping them by phase. The order of the
+// manifests is kept.
+func splitHooks(objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, map[string][]*unstructured.Unstructured, error) {
+	var manifests []*unstructured.Unstructured
+	hooks := map[string][]*unstructured.Unstructured{}
+
+	for _, object := range objects {
+		phase, ok := object.GetAnnotations()[HookAnnotation]
+		if !ok {
+			manifests = append(manifests, object)
+			continue
+		}
+
+		switch phase {
+		case gitopsv1.HookPreSync, gitopsv1.HookPostSync, gitopsv1.HookSyncFail:
+		default:
+			return nil, nil, fmt.Errorf("invalid %s annotation %q on %s", HookAnnotation, phase, resourceReferenceString(resourceReferenceOf(object)))
+		}
+
+		for _, policy := range hookDeletePolicies(object) {
+			if policy != HookDeleteBeforeCreation && policy != HookDeleteSucceeded {
+				return nil, nil, fmt.Errorf("invalid %s annotation %q on %s", HookDeletePolicyAnnotation, policy, resourceReferenceString(resourceReferenceOf(object)))
+			}
+		}
+
+		hooks[phase] = append(hooks[phase], object)
+	}
+
+	return manifests, hooks, nil
+}
+
+// hookDeletePolicies returns the delete policies of a hook.
+func hookDeletePolicies(hook *unstructured.Unstructured) []string {
+	value, ok := hook.GetAnnotations()[HookDeletePolicyAnnotation]
+	if !ok {
+		return []string{HookDeleteBeforeCreation}
+	}
+
+	var policies []string
+	for _, policy := range strings.Split(value, ",") {
+		if policy = strings.TrimSpace(policy); policy != "" {
+			policies = append(policies, policy)
+		}
+	}
+
+	return policies
+}
+
+// hasDeletePolicy tells whether the hook has the delete policy.
+func hasDeletePolicy(hook *unstructured.Unstructured, policy string) bool {
+	for _, current := range hookDeletePolicies(hook) {
+		if current == policy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resetHooks forgets the hooks run for other revisions. On a requested sync failed hooks are run again.
+func resetHooks(application *gitopsv1.Application, revision string) {
+	retry := application.Annotations[ReconcileRequestAnnotation] != application.Status.LastHandledReconcileAt
+
+	var hooks []gitopsv1.HookStatus
+	for _, hook := range application.Status.Hooks {
+		if hook.Revision != revision {
+			continue
+		}
+
+		if retry && hook.State == gitopsv1.HookFailed {
+			hook.State, hook.Message = gitopsv1.HookPending, "Retrying on request"
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	application.Status.Hooks = hooks
+}
+
+// hookStatus returns the recorded state of a hook, or nil if it did not run yet.
+func hookStatus(application *gitopsv1.Application, phase string, ref gitopsv1.ResourceReference) *gitopsv1.HookStatus {
+	for i, hook := range application.Status.Hooks {
+		if hook.Phase == phase && sameResource(hook.ResourceReference, ref) {
+			return &application.Status.Hooks[i]
+		}
+	}
+
+	return nil
+}
+
+// setHookStatus records the state of a hook.
+func setHookStatus(application *gitopsv1.Application, status gitopsv1.HookStatus) {
+	if current := hookStatus(application, status.Phase, status.ResourceReference); current != nil {
+		*current = status
+		return
+	}
+
+	application.Status.Hooks = append(application.Status.Hooks, status)
+}
+
+// hooksRunning tells whether any hook of the Application is still running.
+func hooksRunning(application *gitopsv1.Application) bool {
+	for _, hook := range application.Status.Hooks {
+		if hook.State == gitopsv1.HookRunning {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runHooks runs the hooks of a phase for the revision one after the other, each only once it succeeded. It returns a
+// message about the hook that is still running, or an empty one once all of them succeeded. Hooks that failed are not
+// run again for the revision unless a sync is requested, they fail the phase with a FailedToRunHook error.
+func (r *ApplicationReconciler) runHooks(ctx context.Context, application *gitopsv1.Application, revision, phase string, hooks []*unstructured.Unstructured, logger logr.Logger) (string, error) {
+	for _, hook := range hooks {
+		if err := r.prepareManifest(ctx, application, hook, application.Spec.CreateNamespace, logger); err != nil {
+			return "", err
+		}
+
+		ref := resourceReferenceOf(hook)
+		previous := hookStatus(application, phase, ref)
+
+		if previous != nil {
+			switch previous.State {
+			case gitopsv1.HookSucceeded:
+				continue
+			case gitopsv1.HookFailed:
+				return "", &FailedToRunHook{Phase: phase, Hook: resourceReferenceString(ref), Err: fmt.Errorf("%s", previous.Message)}
+			}
+		}
+
+		retry := previous != nil && previous.State == gitopsv1.HookPending
+		state, message, err := r.runHook(ctx, revision, hook, retry, logger)
+		if err != nil {
+			logger.Error(err, "Failed to run "+phase+" hook: "+resourceReferenceString(ref))
+			return "", err
+		}
+
+		if previous == nil || previous.State != state {
+			switch state {
+			case gitopsv1.HookRunning:
+				r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.HookStartedReason, "Running %s hook %s at revision %s", phase, resourceReferenceString(ref), revision)
+			case gitopsv1.HookSucceeded:
+				r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.HookSucceededReason, "%s hook %s succeeded at revision %s", phase, resourceReferenceString(ref), revision)
+			case gitopsv1.HookFailed:
+				r.Recorder.Eventf(application, corev1.EventTypeWarning, gitopsv1.HookFailedReason, "%s hook %s failed at revision %s: %s", phase, resourceReferenceString(ref), revision, message)
+			}
+		}
+
+		setHookStatus(application, gitopsv1.HookStatus{ResourceReference: ref, Phase: phase, Revision: revision, State: state, Message: message})
+
+		switch state {
+		case gitopsv1.HookSucceeded:
+			continue
+		case gitopsv1.HookFailed:
+			return "", &FailedToRunHook{Phase: phase, Hook: resourceReferenceString(ref), Err: fmt.Errorf("%s", message)}
+		default:
+			return fmt.Sprintf("%s hook %s: %s", phase, resourceReferenceString(ref), message), nil
+		}
+	}
+
+	return "", nil
+}
+
+// runHook makes progress with a single hook and returns its state. The hook is created if it does not exist, and judged
+// by its health once it does: a hook that became healthy, e.g. a completed Job, succeeded, a degraded one failed. A hook
+// left over from another revision, or a failed one that is retried, is deleted first if its delete policy allows it.
+func (r *ApplicationReconciler) runHook(ctx context.Context, revision string, hook *unstructured.Unstructured, retry bool, logger logr.Logger) (string, string, error) {
+	ref := resourceReferenceOf(hook)
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(hook.GroupVersionKind())
+
+	err := r.Get(ctx, client.ObjectKeyFromObject(hook), existing)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", "", err
+	}
+
+	if err == nil {
+		health, message := assessHealth(existing)
+		previousRevision := existing.GetAnnotations()[HookRevisionAnnotation]
+
+		if previousRevision != revision || (retry && health == gitopsv1.HealthDegraded) {
+			if !hasDeletePolicy(hook, HookDeleteBeforeCreation) {
+				return gitopsv1.HookFailed, fmt.Sprintf("Hook of revision %s still exists and the %s delete policy is not set", previousRevision, HookDeleteBeforeCreation), nil
+			}
+
+			if existing.GetDeletionTimestamp() == nil {
+				logger.Info("Deleting hook of a previous run: " + resourceReferenceString(ref))
+				if err := r.deleteHook(ctx, existing); err != nil {
+					return "", "", err
+				}
+			}
+
+			return gitopsv1.HookRunning, "Deleting the hook of a previous run", nil
+		}
+
+		return r.hookState(ctx, hook, existing, health, message, logger)
+	}
+
+	annotations := hook.GetAnnotations()
+	annotations[HookRevisionAnnotation] = revision
+	hook.SetAnnotations(annotations)
+
+	logger.Info("Creating hook: " + resourceReferenceString(ref))
+	if err := r.Patch(ctx, hook, client.Apply, r.applyOptions(true)...); err != nil {
+		return "", "", &FailedToReconcileManifest{Err: err}
+	}
+
+	health, message := assessHealth(hook)
+
+	return r.hookState(ctx, hook, hook, health, message, logger)
+}
+
+// hookState turns the health of a hook into its state, deleting the hook once it succeeded if its delete policy says so.
+func (r *ApplicationReconciler) hookState(ctx context.Context, hook, live *unstructured.Unstructured, health, message string, logger logr.Logger) (string, string, error) {
+	switch health {
+	case gitopsv1.HealthHealthy:
+		if hasDeletePolicy(hook, HookDeleteSucceeded) {
+			logger.Info("Deleting succeeded hook: " + resourceReferenceString(resourceReferenceOf(hook)))
+			if err := r.deleteHook(ctx, live); err != nil {
+				return "", "", err
+			}
+		}
+
+		return gitopsv1.HookSucceeded, "", nil
+	case gitopsv1.HealthDegraded:
+		return gitopsv1.HookFailed, message, nil
+	}
+
+	if message == "" {
+		message = "Waiting for the hook to complete"
+	}
+
+	return gitopsv1.HookRunning, message, nil
+}
+
+// deleteHook deletes a hook along with its dependents, e.g. the Pods of a Job.
+func (r *ApplicationReconciler) deleteHook(ctx context.Context, hook *unstructured.Unstructured) error {
+	propagationPolicy := metav1.DeletePropagationBackground
+	if err := r.Delete(ctx, hook, &client.DeleteOptions{PropagationPolicy: &propagationPolicy}); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// runSyncFailHooks runs the SyncFail hooks after the sync of revision failed. Their failures are only logged, the
+// sync failed already.
+func (r *ApplicationReconciler) runSyncFailHooks(ctx context.Context, application *gitopsv1.Application, revision string, hooks []*unstructured.Unstructured, logger logr.Logger) {
+	if _, err := r.runHooks(ctx, application, revision, gitopsv1.HookSyncFail, hooks, logger); err != nil {
+		logger.Error(err, "Failed to run SyncFail hooks")
+	}
+}
+
+// runPostSyncHooks runs the PostSync hooks once the objects applied by the sync of revision are healthy. The
+// Application is not Ready until the hooks succeeded, a failed hook fails the sync.
+func (r *ApplicationReconciler) runPostSyncHooks(ctx context.Context, application *gitopsv1.Application, revision string, hooks map[string][]*unstructured.Unstructured, logger logr.Logger) error {
+	if len(hooks[gitopsv1.HookPostSync]) == 0 {
+		return nil
+	}
+
+	healthy := meta.FindStatusCondition(application.Status.Conditions, gitopsv1.HealthyCondition)
+	if healthy == nil || healthy.Status == metav1.ConditionFalse {
+		// Unhealthy objects already make the Application not Ready
+		return nil
+	}
+
+	if healthy.Status == metav1.ConditionUnknown {
+		setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionUnknown, gitopsv1.WaitingForHookReason, "Waiting for the applied objects to become healthy to run the PostSync hooks")
+		return nil
+	}
+
+	waiting, err := r.runHooks(ctx, application, revision, gitopsv1.HookPostSync, hooks[gitopsv1.HookPostSync], logger)
+	if err != nil {
+		reason, stalled := gitopsv1.ApplyFailedReason, metav1.ConditionFalse
+		if _, ok := err.(*FailedToRunHook); ok {
+			reason, stalled = gitopsv1.HookFailedReason, metav1.ConditionTrue
+		}
+
+		setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionFalse, reason, err.Error())
+		setCondition(application, gitopsv1.StalledCondition, stalled, reason, err.Error())
+		r.runSyncFailHooks(ctx, application, revision, hooks[gitopsv1.HookSyncFail], logger)
+		return err
+	}
+
+	if waiting != "" {
+		setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionUnknown, gitopsv1.WaitingForHookReason, "Waiting for "+waiting)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Hooks", func() {
+	ctx := context.Background()
+	revision := "0123456789abcdef"
+
+	manifest := func(name string, annotations map[string]string) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{}
+		object.SetAPIVersion("batch/v1")
+		object.SetKind("Job")
+		object.SetNamespace("default")
+		object.SetName(name)
+		object.SetAnnotations(annotations)
+		return object
+	}
+
+	Context("When splitting hooks from the manifests", func() {
+		It("Should group the hooks by phase", func() {
+			deployment := manifest("deployment", nil)
+			migrate := manifest("migrate", map[string]string{HookAnnotation: gitopsv1.HookPreSync})
+			smoke := manifest("smoke", map[string]string{HookAnnotation: gitopsv1.HookPostSync})
+
+			objects, hooks, err := splitHooks([]*unstructured.Unstructured{migrate, deployment, smoke})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(objects).Should(Equal([]*unstructured.Unstructured{deployment}))
+			Expect(hooks[gitopsv1.HookPreSync]).Should(Equal([]*unstructured.Unstructured{migrate}))
+			Expect(hooks[gitopsv1.HookPostSync]).Should(Equal([]*unstructured.Unstructured{smoke}))
+		})
+
+		It("Should reject unknown phases and delete policies", func() {
+			_, _, err := splitHooks([]*unstructured.Unstructured{manifest("migrate", map[string]string{HookAnnotation: "PreApply"})})
+			Expect(err).Should(HaveOccurred())
+
+			_, _, err = splitHooks([]*unstructured.Unstructured{manifest("migrate", map[string]string{HookAnnotation: gitopsv1.HookPreSync, HookDeletePolicyAnnotation: "Never"})})
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("Should delete hooks before creating them again unless told otherwise", func() {
+			Expect(hookDeletePolicies(manifest("migrate", nil))).Should(Equal([]string{HookDeleteBeforeCreation}))
+			Expect(hookDeletePolicies(manifest("migrate", map[string]string{HookDeletePolicyAnnotation: "HookSucceeded, BeforeHookCreation"}))).Should(Equal([]string{HookDeleteSucceeded, HookDeleteBeforeCreation}))
+		})
+	})
+
+	Context("When running hooks", func() {
+		var reconciler *ApplicationReconciler
+		var application *gitopsv1.Application
+
+		job := func(name string, condition batchv1.JobConditionType) *batchv1.Job {
+			return &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{HookRevisionAnnotation: revision}},
+				Status:     batchv1.JobStatus{Conditions: []batchv1.JobCondition{{Type: condition, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}},
+			}
+		}
+
+		BeforeEach(func() {
+			application = &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "cowsay", Namespace: "default", UID: "cowsay-uid"}}
+
+			scheme := runtime.NewScheme()
+			Expect(corev1.AddToScheme(scheme)).Should(Succeed())
+			Expect(batchv1.AddToScheme(scheme)).Should(Succeed())
+			Expect(gitopsv1.AddToScheme(scheme)).Should(Succeed())
+
+			mapper := meta.NewDefaultRESTMapper(nil)
+			mapper.Add(batchv1.SchemeGroupVersion.WithKind("Job"), meta.RESTScopeNamespace)
+
+			reconciler = &ApplicationReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithObjects(job("migrate", batchv1.JobComplete), job("seed", batchv1.JobFailed)).Build(),
+				Scheme:   scheme,
+				Recorder: record.NewFakeRecorder(10),
+			}
+		})
+
+		It("Should record completed hooks as succeeded and delete them if asked to", func() {
+			hooks := []*unstructured.Unstructured{manifest("migrate", map[string]string{HookAnnotation: gitopsv1.HookPreSync, HookDeletePolicyAnnotation: HookDeleteSucceeded})}
+
+			waiting, err := reconciler.runHooks(ctx, application, revision, gitopsv1.HookPreSync, hooks, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(waiting).Should(BeEmpty())
+			Expect(application.Status.Hooks).Should(HaveLen(1))
+			Expect(application.Status.Hooks[0].State).Should(Equal(gitopsv1.HookSucceeded))
+
+			err = reconciler.Get(ctx, types.NamespacedName{Namespace: "default", Name: "migrate"}, &batchv1.Job{})
+			Expect(errors.IsNotFound(err)).Should(BeTrue())
+
+			// The recorded state keeps the hook from running again for the revision
+			waiting, err = reconciler.runHooks(ctx, application, revision, gitopsv1.HookPreSync, hooks, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(waiting).Should(BeEmpty())
+		})
+
+		It("Should stop at a failed hook until a sync is requested", func() {
+			hooks := []*unstructured.Unstructured{
+				manifest("seed", map[string]string{HookAnnotation: gitopsv1.HookPreSync}),
+				manifest("migrate", map[string]string{HookAnnotation: gitopsv1.HookPreSync}),
+			}
+
+			_, err := reconciler.runHooks(ctx, application, revision, gitopsv1.HookPreSync, hooks, logf.Log)
+			Expect(err).Should(BeAssignableToTypeOf(&FailedToRunHook{}))
+			Expect(application.Status.Hooks).Should(HaveLen(1))
+			Expect(application.Status.Hooks[0].State).Should(Equal(gitopsv1.HookFailed))
+
+			application.Annotations = map[string]string{ReconcileRequestAnnotation: "now"}
+			resetHooks(application, revision)
+			Expect(application.Status.Hooks[0].State).Should(Equal(gitopsv1.HookPending))
+
+			// Retrying deletes the failed Job before creating it again
+			waiting, err := reconciler.runHooks(ctx, application, revision, gitopsv1.HookPreSync, hooks, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(waiting).ShouldNot(BeEmpty())
+
+			err = reconciler.Get(ctx, types.NamespacedName{Namespace: "default", Name: "seed"}, &batchv1.Job{})
+			Expect(errors.IsNotFound(err)).Should(BeTrue())
+		})
+
+		It("Should forget the hooks of other revisions", func() {
+			application.Status.Hooks = []gitopsv1.HookStatus{{Phase: gitopsv1.HookPreSync, Revision: "previous", State: gitopsv1.HookSucceeded}}
+
+			resetHooks(application, revision)
+			Expect(application.Status.Hooks).Should(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,312 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	"sigs.k8s.io/yaml"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// hasKustomization reports whether dir holds a kustomization file.
+func hasKustomization(dir string) bool {
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isKustomizationFile reports whether name is the name of a kustomization file.
+func isKustomizationFile(name string) bool {
+	for _, recognized := range konfig.RecognizedKustomizationFileNames() {
+		if name == recognized {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildKustomization renders the kustomization in dir of the checkout at root. The kustomization is read from disk
+// through a read-only filesystem confined to the checkout, so its resources and bases cannot reach anything outside of
+// it, e.g. the worktrees of other Applications in the repository cache. Without a kustomization file, one listing files
+// as its resources is generated in memory, so the checkout is never modified. The overrides of the Application are
+// applied by a second in-memory kustomization on top of the rendered objects.
+func buildKustomization(root, dir string, files []string, overrides *gitopsv1.KustomizeSpec) ([]byte, error) {
+	var rendered []byte
+	var err error
+
+	if hasKustomization(dir) {
+		rendered, err = buildRepositoryKustomization(root, dir)
+	} else {
+		rendered, err = buildGeneratedKustomization(dir, files)
+	}
+
+	if err != nil || overrides == nil {
+		return rendered, err
+	}
+
+	fileSystem := filesys.MakeFsInMemory()
+	if err := fileSystem.WriteFile("/resources.yaml", rendered); err != nil {
+		return nil, err
+	}
+
+	kustomization := overridesKustomization(overrides)
+	kustomization.Resources = []string{"resources.yaml"}
+
+	if err := writeKustomization(fileSystem, "/", kustomization); err != nil {
+		return nil, err
+	}
+
+	return runKustomize(fileSystem, "/")
+}
+
+// buildRepositoryKustomization renders the kustomization in dir, reading only the files of the checkout at root.
+func buildRepositoryKustomization(root, dir string) ([]byte, error) {
+	fileSystem, err := newConfinedFileSystem(root)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err = fileSystem.resolve(dir)
+	if err != nil {
+		return nil, fmt.Errorf("kustomization %w", err)
+	}
+
+	return runKustomize(fileSystem, dir)
+}
+
+// errReadOnly is returned by confinedFileSystem for anything that would modify the checkout
+var errReadOnly = errors.New("the repository is read-only")
+
+// confinedFileSystem is a read-only filesystem on disk that only reaches the files below its root. Paths outside of it,
+// e.g. relative bases going up too many directories or symbolic links pointing elsewhere, do not exist for kustomize,
+// and neither do remote bases, which are cloned to a temporary directory.
+type confinedFileSystem struct {
+	filesys.FileSystem
+	root string
+}
+
+func newConfinedFileSystem(root string) (*confinedFileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &confinedFileSystem{FileSystem: filesys.MakeFsOnDisk(), root: root}, nil
+}
+
+// resolve returns the absolute path with symbolic links resolved, or an error if it is outside of the root.
+func (c *confinedFileSystem) resolve(path string) (string, error) {
+	resolved, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	if linked, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = linked
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	relative, err := filepath.Rel(c.root, resolved)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the repository", path)
+	}
+
+	return resolved, nil
+}
+
+func (c *confinedFileSystem) Create(string) (filesys.File, error) { return nil, errReadOnly }
+func (c *confinedFileSystem) Mkdir(string) error                  { return errReadOnly }
+func (c *confinedFileSystem) MkdirAll(string) error               { return errReadOnly }
+func (c *confinedFileSystem) RemoveAll(string) error              { return errReadOnly }
+func (c *confinedFileSystem) WriteFile(string, []byte) error      { return errReadOnly }
+
+func (c *confinedFileSystem) Open(path string) (filesys.File, error) {
+	resolved, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.FileSystem.Open(resolved)
+}
+
+func (c *confinedFileSystem) IsDir(path string) bool {
+	resolved, err := c.resolve(path)
+	return err == nil && c.FileSystem.IsDir(resolved)
+}
+
+func (c *confinedFileSystem) ReadDir(path string) ([]string, error) {
+	resolved, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.FileSystem.ReadDir(resolved)
+}
+
+func (c *confinedFileSystem) CleanedAbs(path string) (filesys.ConfirmedDir, string, error) {
+	resolved, err := c.resolve(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	return c.FileSystem.CleanedAbs(resolved)
+}
+
+func (c *confinedFileSystem) Exists(path string) bool {
+	resolved, err := c.resolve(path)
+	return err == nil && c.FileSystem.Exists(resolved)
+}
+
+func (c *confinedFileSystem) Glob(pattern string) ([]string, error) {
+	matches, err := c.FileSystem.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var confined []string
+	for _, match := range matches {
+		if _, err := c.resolve(match); err == nil {
+			confined = append(confined, match)
+		}
+	}
+
+	return confined, nil
+}
+
+func (c *confinedFileSystem) ReadFile(path string) ([]byte, error) {
+	resolved, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.FileSystem.ReadFile(resolved)
+}
+
+func (c *confinedFileSystem) Walk(path string, walkFn filepath.WalkFunc) error {
+	resolved, err := c.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	return c.FileSystem.Walk(resolved, walkFn)
+}
+
+// buildGeneratedKustomization copies files of dir into memory next to a kustomization listing them and renders it.
+func buildGeneratedKustomization(dir string, files []string) ([]byte, error) {
+	fileSystem := filesys.MakeFsInMemory()
+
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := fileSystem.MkdirAll(filepath.Dir("/" + file)); err != nil {
+			return nil, err
+		}
+
+		if err := fileSystem.WriteFile("/"+file, content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeKustomization(fileSystem, "/", &types.Kustomization{Resources: files}); err != nil {
+		return nil, err
+	}
+
+	return runKustomize(fileSystem, "/")
+}
+
+func overridesKustomization(overrides *gitopsv1.KustomizeSpec) *types.Kustomization {
+	kustomization := &types.Kustomization{
+		NamePrefix:   overrides.NamePrefix,
+		CommonLabels: overrides.CommonLabels,
+	}
+
+	for _, image := range overrides.Images {
+		kustomization.Images = append(kustomization.Images, types.Image{
+			Name:    image.Name,
+			NewName: image.NewName,
+			NewTag:  image.NewTag,
+			Digest:  image.Digest,
+		})
+	}
+
+	for _, patch := range overrides.Patches {
+		kustomizePatch := types.Patch{Patch: patch.Patch}
+
+		if patch.Target != nil {
+			kustomizePatch.Target = &types.Selector{
+				ResId: resid.ResId{
+					Gvk:       resid.Gvk{Group: patch.Target.Group, Version: patch.Target.Version, Kind: patch.Target.Kind},
+					Name:      patch.Target.Name,
+					Namespace: patch.Target.Namespace,
+				},
+				AnnotationSelector: patch.Target.AnnotationSelector,
+				LabelSelector:      patch.Target.LabelSelector,
+			}
+		}
+
+		kustomization.Patches = append(kustomization.Patches, kustomizePatch)
+	}
+
+	return kustomization
+}
+
+func writeKustomization(fileSystem filesys.FileSystem, dir string, kustomization *types.Kustomization) error {
+	kustomization.APIVersion = types.KustomizationVersion
+	kustomization.Kind = types.KustomizationKind
+
+	content, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return err
+	}
+
+	return fileSystem.WriteFile(filepath.Join(dir, konfig.DefaultKustomizationFileName()), content)
+}
+
+func runKustomize(fileSystem filesys.FileSystem, dir string) ([]byte, error) {
+	resources, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fileSystem, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return resources.AsYaml()
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Kustomize", func() {
+	var cache, repository string
+
+	deployment := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: cowsay
+spec:
+  template:
+    spec:
+      containers:
+      - name: cowsay
+        image: cowsay:1.0.0
+`
+
+	service := `apiVersion: v1
+kind: Service
+metadata:
+  name: cowsay
+`
+
+	write := func(root string, files map[string]string) {
+		for file, content := range files {
+			Expect(os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, file), []byte(content), 0644)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		cache, err = os.MkdirTemp("", "kustomize")
+		Expect(err).NotTo(HaveOccurred())
+
+		// Laid out like the worktrees of two Applications in the repository cache
+		repository = filepath.Join(cache, "worktrees", "tenant", "cowsay", "0123456789abcdef")
+		write(filepath.Join(cache, "worktrees", "other", "secrets", "fedcba9876543210"), map[string]string{
+			"kubernetes/kustomization.yaml": "resources:\n- secret.yaml\n",
+			"kubernetes/secret.yaml":        "apiVersion: v1\nkind: Secret\nmetadata:\n  name: password\n",
+		})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cache)).To(Succeed())
+	})
+
+	Context("When detecting kustomizations", func() {
+		It("Should recognize every kustomization file name", func() {
+			write(repository, map[string]string{"plain/deployment.yaml": deployment, "upper/Kustomization": "resources: []\n", "yml/kustomization.yml": "resources: []\n"})
+
+			Expect(hasKustomization(filepath.Join(repository, "plain"))).Should(BeFalse())
+			Expect(hasKustomization(filepath.Join(repository, "upper"))).Should(BeTrue())
+			Expect(hasKustomization(filepath.Join(repository, "yml"))).Should(BeTrue())
+		})
+	})
+
+	Context("When building a kustomization", func() {
+		It("Should generate one from the discovered files without touching the checkout", func() {
+			write(repository, map[string]string{"kubernetes/deployment.yaml": deployment, "kubernetes/base/service.yaml": service})
+			dir := filepath.Join(repository, "kubernetes")
+
+			rendered, err := buildKustomization(repository, dir, []string{"base/service.yaml", "deployment.yaml"}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(rendered)).Should(ContainSubstring("kind: Service"))
+			Expect(string(rendered)).Should(ContainSubstring("kind: Deployment"))
+			Expect(hasKustomization(dir)).Should(BeFalse())
+		})
+
+		It("Should apply the images, namePrefix and commonLabels overrides", func() {
+			write(repository, map[string]string{"kubernetes/deployment.yaml": deployment})
+
+			rendered, err := buildKustomization(repository, filepath.Join(repository, "kubernetes"), []string{"deployment.yaml"}, &gitopsv1.KustomizeSpec{
+				Images:       []gitopsv1.KustomizeImage{{Name: "cowsay", NewTag: "2.0.0"}},
+				NamePrefix:   "prod-",
+				CommonLabels: map[string]string{"team": "potato"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(rendered)).Should(ContainSubstring("image: cowsay:2.0.0"))
+			Expect(string(rendered)).Should(ContainSubstring("name: prod-cowsay"))
+			Expect(string(rendered)).Should(ContainSubstring("team: potato"))
+		})
+
+		It("Should render the namespace and bases of a kustomization in the repository", func() {
+			write(repository, map[string]string{
+				"kubernetes/base/kustomization.yaml":          "resources:\n- deployment.yaml\n",
+				"kubernetes/base/deployment.yaml":             deployment,
+				"kubernetes/overlays/prod/kustomization.yaml": "namespace: cowsay\nresources:\n- ../../base\n",
+			})
+
+			rendered, err := buildKustomization(repository, filepath.Join(repository, "kubernetes", "overlays", "prod"), nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(rendered)).Should(ContainSubstring("namespace: cowsay"))
+			Expect(string(rendered)).Should(ContainSubstring("kind: Deployment"))
+		})
+
+		It("Should not read the worktrees of other Applications through bases outside of the repository", func() {
+			write(repository, map[string]string{
+				"kubernetes/kustomization.yaml": "resources:\n- ../../../../other/secrets/fedcba9876543210/kubernetes\n",
+			})
+
+			rendered, err := buildKustomization(repository, filepath.Join(repository, "kubernetes"), nil, nil)
+			Expect(err).Should(HaveOccurred())
+			Expect(string(rendered)).ShouldNot(ContainSubstring("password"))
+		})
+
+		It("Should not follow symbolic links outside of the repository", func() {
+			write(repository, map[string]string{"kubernetes/kustomization.yaml": "resources:\n- secrets\n"})
+			Expect(os.Symlink(filepath.Join(cache, "worktrees", "other", "secrets", "fedcba9876543210", "kubernetes"), filepath.Join(repository, "kubernetes", "secrets"))).To(Succeed())
+
+			rendered, err := buildKustomization(repository, filepath.Join(repository, "kubernetes"), nil, nil)
+			Expect(err).Should(HaveOccurred())
+			Expect(string(rendered)).ShouldNot(ContainSubstring("password"))
+		})
+
+		It("Should not read files outside of the repository", func() {
+			write(repository, map[string]string{
+				"kubernetes/kustomization.yaml": "resources:\n- ../../../../other/secrets/fedcba9876543210/kubernetes/secret.yaml\n",
+			})
+
+			_, err := buildKustomization(repository, filepath.Join(repository, "kubernetes"), nil, nil)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
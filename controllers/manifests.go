@@ -0,0 +1,333 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"io"
+	"io/fs"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// DefaultManifestsPath is the directory of the repository manifests are read from if spec.path is not set
+const DefaultManifestsPath = "kubernetes"
+
+// manifestExtensions are the file extensions considered to be manifests
+var manifestExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// chartFileName is the file that makes a directory a Helm chart
+const chartFileName = "Chart.yaml"
+
+// nonManifestFiles are files with a manifest extension that are not Kubernetes objects, but describe a Helm chart
+var nonManifestFiles = map[string]bool{chartFileName: true, "values.yaml": true, "values.schema.json": true}
+
+// manifestsDir returns the directory holding the manifests of the Application within repositoryPath. The path is
+// cleaned as if it was absolute, so it cannot point outside of the repository.
+func manifestsDir(application *gitopsv1.Application, repositoryPath string) string {
+	manifestsPath := application.Spec.Path
+	if manifestsPath == "" {
+		manifestsPath = DefaultManifestsPath
+	}
+
+	return filepath.Join(repositoryPath, filepath.Clean("/"+manifestsPath))
+}
+
+// discoverManifests walks manifestsDir recursively and returns the paths of the manifests relative to it in lexical
+// order. Only files with a manifest extension are considered, matching at least one include glob if there are any and
+// none of the exclude globs. Subdirectories holding a kustomization or a Helm chart are skipped, as their files are not
+// plain objects, and so are kustomization files and the files describing a chart.
+func discoverManifests(manifestsDir string, include, exclude []string) ([]string, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %s: %w", pattern, err)
+		}
+	}
+
+	var manifests []string
+
+	err := filepath.WalkDir(manifestsDir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			if file != manifestsDir && (hasKustomization(file) || hasChart(file)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !manifestExtensions[strings.ToLower(filepath.Ext(file))] || nonManifestFiles[entry.Name()] || isKustomizationFile(entry.Name()) {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(manifestsDir, file)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+
+		if len(include) > 0 && !matchesAnyGlob(include, relativePath) {
+			return nil
+		}
+
+		if matchesAnyGlob(exclude, relativePath) {
+			return nil
+		}
+
+		manifests = append(manifests, relativePath)
+		return nil
+	})
+
+	return manifests, err
+}
+
+// hasChart reports whether dir holds a Helm chart.
+func hasChart(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, chartFileName))
+	return err == nil
+}
+
+// matchesAnyGlob reports whether file matches one of the globs. A glob without a slash is matched against the file
+// name only, and `**` matches any number of directories.
+func matchesAnyGlob(globs []string, file string) bool {
+	for _, glob := range globs {
+		if !strings.Contains(glob, "/") {
+			if matched, _ := path.Match(glob, path.Base(file)); matched {
+				return true
+			}
+			continue
+		}
+
+		if matchGlobSegments(strings.Split(glob, "/"), strings.Split(file, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchGlobSegments(glob, file []string) bool {
+	if len(glob) == 0 {
+		return len(file) == 0
+	}
+
+	if glob[0] == "**" {
+		for i := 0; i <= len(file); i++ {
+			if matchGlobSegments(glob[1:], file[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(file) == 0 {
+		return false
+	}
+
+	if matched, _ := path.Match(glob[0], file[0]); !matched {
+		return false
+	}
+
+	return matchGlobSegments(glob[1:], file[1:])
+}
+
+type FailedToRenderManifests struct {
+	Reason string
+	Err    error
+	// Stalled is set if the failure cannot go away without a change to the Application or its repository
+	Stalled bool
+}
+
+func (e *FailedToRenderManifests) Error() string {
+	return "Failed to render manifests: " + e.Err.Error()
+}
+
+func (e *FailedToRenderManifests) Unwrap() error {
+	return e.Err
+}
+
+// renderManifests returns the objects described by the repository of the Application. A Helm chart is rendered if
+// spec.helm is set, a kustomization if spec.kustomize is set or there is a kustomization file at the manifests path,
+// and the plain manifests at the path are read otherwise.
+func (r *ApplicationReconciler) renderManifests(ctx context.Context, application *gitopsv1.Application, repositoryPath string, logger logr.Logger) ([]*unstructured.Unstructured, error) {
+	manifestsDir := manifestsDir(application, repositoryPath)
+
+	if application.Spec.Helm != nil {
+		chartDir := manifestsDir
+		if application.Spec.Helm.Chart != "" {
+			chartDir = filepath.Join(repositoryPath, filepath.Clean("/"+application.Spec.Helm.Chart))
+		}
+
+		logger.Info("Rendering Helm chart in: " + chartDir)
+
+		// Values can come from Secrets and ConfigMaps that may show up later, so failures are retried
+		rendered, err := r.renderHelmChart(ctx, application, repositoryPath, chartDir, logger)
+		if err != nil {
+			logger.Error(err, "Failed to render Helm chart in: "+chartDir)
+			return nil, &FailedToRenderManifests{Reason: gitopsv1.BuildFailedReason, Err: err}
+		}
+
+		return r.decodeRendered(rendered, "chart", logger)
+	}
+
+	files, err := discoverManifests(manifestsDir, application.Spec.Include, application.Spec.Exclude)
+	if err != nil {
+		logger.Error(err, "Failed to read manifests in: "+manifestsDir)
+		return nil, &FailedToRenderManifests{Reason: gitopsv1.ManifestsNotFoundReason, Err: err, Stalled: true}
+	}
+
+	for _, file := range files {
+		logger.Info("Found manifest: " + file)
+	}
+
+	if application.Spec.Kustomize != nil || hasKustomization(manifestsDir) {
+		logger.Info("Building kustomization in: " + manifestsDir)
+
+		rendered, err := buildKustomization(repositoryPath, manifestsDir, files, application.Spec.Kustomize)
+		if err != nil {
+			logger.Error(err, "Failed to build kustomization in: "+manifestsDir)
+			return nil, &FailedToRenderManifests{Reason: gitopsv1.BuildFailedReason, Err: fmt.Errorf("failed to build kustomization: %w", err), Stalled: true}
+		}
+
+		return r.decodeRendered(rendered, "kustomization", logger)
+	}
+
+	var objects []*unstructured.Unstructured
+
+	for _, file := range files {
+		decoded, err := r.decodeManifest(manifestsDir, file, logger)
+
+		if err != nil {
+			logger.Error(err, "Failed to decode manifest: "+file+", bailing out")
+			return nil, &FailedToRenderManifests{Reason: gitopsv1.DecodeFailedReason, Err: err, Stalled: true}
+		}
+
+		objects = append(objects, decoded...)
+	}
+
+	return objects, nil
+}
+
+// decodeRendered decodes the output of a kustomize or Helm build.
+func (r *ApplicationReconciler) decodeRendered(rendered []byte, name string, logger logr.Logger) ([]*unstructured.Unstructured, error) {
+	objects, err := r.decodeStream(bytes.NewReader(rendered), name, logger)
+	if err != nil {
+		logger.Error(err, "Failed to decode rendered "+name+", bailing out")
+		return nil, &FailedToRenderManifests{Reason: gitopsv1.DecodeFailedReason, Err: err, Stalled: true}
+	}
+
+	return objects, nil
+}
+
+// decodeManifest reads a manifest file and decodes all objects in it.
+func (r *ApplicationReconciler) decodeManifest(manifestsDir string, file string, logger logr.Logger) ([]*unstructured.Unstructured, error) {
+	manifest := filepath.Join(manifestsDir, file)
+
+	stream, err := os.Open(manifest)
+	if err != nil {
+		logger.Error(err, "Failed to read manifest file: "+manifest)
+		return nil, err
+	}
+	defer stream.Close()
+
+	return r.decodeStream(stream, file, logger)
+}
+
+// decodeStream decodes all objects of a YAML or JSON stream named name in errors and logs. YAML streams are split into
+// their documents, empty documents and documents holding only comments are skipped, and List kinds are expanded into
+// their items.
+func (r *ApplicationReconciler) decodeStream(stream io.Reader, name string, logger logr.Logger) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+
+	reader := yaml.NewYAMLReader(bufio.NewReader(stream))
+	for index := 1; ; index++ {
+		document, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %w", name, index, err)
+		}
+
+		decoded, err := decodeDocument(document)
+		if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %w", name, index, err)
+		}
+
+		for _, object := range decoded {
+			logger.Info(fmt.Sprintf("Parsed a %s from %s document %d", object.GroupVersionKind(), name, index))
+		}
+
+		objects = append(objects, decoded...)
+	}
+
+	return objects, nil
+}
+
+// decodeDocument decodes a single YAML or JSON document, returning nothing for empty documents and the items of List
+// kinds.
+func decodeDocument(document []byte) ([]*unstructured.Unstructured, error) {
+	data, err := yaml.ToJSON(document)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+
+	object := &unstructured.Unstructured{}
+	if _, _, err := unstructured.UnstructuredJSONScheme.Decode(data, nil, object); err != nil {
+		return nil, err
+	}
+
+	if !object.IsList() {
+		return []*unstructured.Unstructured{object}, nil
+	}
+
+	list, err := object.ToList()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*unstructured.Unstructured
+	for i := range list.Items {
+		if list.Items[i].GetAPIVersion() == "" || list.Items[i].GetKind() == "" {
+			return nil, fmt.Errorf("item %d of %s is missing apiVersion or kind", i, object.GetKind())
+		}
+
+		objects = append(objects, &list.Items[i])
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Manifest discovery", func() {
+	var directory string
+
+	BeforeEach(func() {
+		var err error
+		directory, err = os.MkdirTemp("", "manifests")
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, file := range []string{"deployment.yaml", "README.md", "base/service.yml", "base/config.json", "overlays/prod/patch.yaml", ".git/config.yaml"} {
+			Expect(os.MkdirAll(filepath.Join(directory, filepath.Dir(file)), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(directory, file), []byte{}, 0644)).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(directory)).To(Succeed())
+	})
+
+	It("Should find manifests recursively", func() {
+		Expect(discoverManifests(directory, nil, nil)).Should(Equal([]string{
+			"base/config.json", "base/service.yml", "deployment.yaml", "overlays/prod/patch.yaml",
+		}))
+	})
+
+	It("Should skip kustomizations and Helm charts in subdirectories", func() {
+		for _, file := range []string{"kustomization.yaml", "apps/kustomization.yaml", "apps/patch.yaml", "charts/cowsay/Chart.yaml", "charts/cowsay/values.yaml", "charts/cowsay/templates/deployment.yaml"} {
+			Expect(os.MkdirAll(filepath.Join(directory, filepath.Dir(file)), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(directory, file), []byte{}, 0644)).To(Succeed())
+		}
+
+		Expect(discoverManifests(directory, nil, nil)).Should(Equal([]string{
+			"base/config.json", "base/service.yml", "deployment.yaml", "overlays/prod/patch.yaml",
+		}))
+	})
+
+	It("Should apply include and exclude globs", func() {
+		Expect(discoverManifests(directory, []string{"base/*", "**/*.yaml"}, []string{"*.json"})).Should(Equal([]string{
+			"base/service.yml", "deployment.yaml", "overlays/prod/patch.yaml",
+		}))
+	})
+
+	It("Should not allow the path to point outside of the repository", func() {
+		application := &gitopsv1.Application{Spec: gitopsv1.ApplicationSpec{Path: "../../etc"}}
+
+		Expect(manifestsDir(application, "/tmp/repository")).Should(Equal("/tmp/repository/etc"))
+	})
+
+	Context("When decoding a manifest", func() {
+		It("Should split YAML streams and expand lists", func() {
+			Expect(os.WriteFile(filepath.Join(directory, "stream.yaml"), []byte(`# Only a comment
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+---
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: cowsay
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: cowsay
+`), 0644)).To(Succeed())
+
+			objects, err := (&ApplicationReconciler{}).decodeManifest(directory, "stream.yaml", logf.Log)
+			Expect(err).NotTo(HaveOccurred())
+
+			var kinds []string
+			for _, object := range objects {
+				kinds = append(kinds, object.GetKind())
+			}
+			Expect(kinds).Should(Equal([]string{"ConfigMap", "Service", "Deployment"}))
+		})
+
+		It("Should report the file and document of a broken manifest", func() {
+			Expect(os.WriteFile(filepath.Join(directory, "broken.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\n---\nfoo: [\n"), 0644)).To(Succeed())
+
+			_, err := (&ApplicationReconciler{}).decodeManifest(directory, "broken.yaml", logf.Log)
+			Expect(err).Should(MatchError(ContainSubstring("broken.yaml: document 2")))
+		})
+	})
+})
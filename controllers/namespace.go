@@ -0,0 +1,77 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// targetNamespace returns the namespace a namespaced object of the Application is applied to: the target namespace of
+// the Application if set, else the namespace of the manifest, else the namespace of the Application.
+func targetNamespace(application *gitopsv1.Application, object *unstructured.Unstructured) string {
+	if application.Spec.TargetNamespace != "" {
+		return application.Spec.TargetNamespace
+	}
+
+	if object.GetNamespace() != "" {
+		return object.GetNamespace()
+	}
+
+	return application.Namespace
+}
+
+// releaseNamespace returns the namespace a Helm chart of the Application is rendered for.
+func releaseNamespace(application *gitopsv1.Application) string {
+	if application.Spec.TargetNamespace != "" {
+		return application.Spec.TargetNamespace
+	}
+
+	return application.Namespace
+}
+
+// ensureNamespace creates the namespace if it does not exist yet. Created namespaces are not part of the inventory, so
+// they are never pruned together with the objects in them.
+func (r *ApplicationReconciler) ensureNamespace(ctx context.Context, name string, logger logr.Logger) error {
+	namespace := &corev1.Namespace{}
+
+	err := r.Get(ctx, types.NamespacedName{Name: name}, namespace)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get namespace: "+name)
+		return err
+	}
+
+	logger.Info("Creating namespace: " + name)
+
+	namespace.Name = name
+	if err := r.Create(ctx, namespace); err != nil && !errors.IsAlreadyExists(err) {
+		logger.Error(err, "Failed to create namespace: "+name)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Target namespace", func() {
+	var application *gitopsv1.Application
+	var object *unstructured.Unstructured
+
+	BeforeEach(func() {
+		application = &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "cowsay", Namespace: "apps"}}
+		object = &unstructured.Unstructured{}
+	})
+
+	Context("When resolving the namespace of a namespaced object", func() {
+		It("Should prefer the target namespace of the Application", func() {
+			application.Spec.TargetNamespace = "production"
+			object.SetNamespace("staging")
+
+			Expect(targetNamespace(application, object)).Should(Equal("production"))
+		})
+
+		It("Should keep the namespace of the manifest without a target namespace", func() {
+			object.SetNamespace("staging")
+
+			Expect(targetNamespace(application, object)).Should(Equal("staging"))
+		})
+
+		It("Should fall back to the namespace of the Application", func() {
+			Expect(targetNamespace(application, object)).Should(Equal("apps"))
+		})
+	})
+
+	Context("When Applications are restricted to their own namespace", func() {
+		var reconciler *ApplicationReconciler
+
+		manifest := func(kind, apiVersion, namespace string) *unstructured.Unstructured {
+			object := &unstructured.Unstructured{}
+			object.SetAPIVersion(apiVersion)
+			object.SetKind(kind)
+			object.SetNamespace(namespace)
+			object.SetName("cowsay")
+			return object
+		}
+
+		BeforeEach(func() {
+			application.UID = "cowsay-uid"
+
+			scheme := runtime.NewScheme()
+			Expect(gitopsv1.AddToScheme(scheme)).Should(Succeed())
+
+			mapper := meta.NewDefaultRESTMapper(nil)
+			mapper.Add(appsv1.SchemeGroupVersion.WithKind("Deployment"), meta.RESTScopeNamespace)
+			mapper.Add(rbacv1.SchemeGroupVersion.WithKind("ClusterRoleBinding"), meta.RESTScopeRoot)
+
+			reconciler = &ApplicationReconciler{
+				Client:            fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).Build(),
+				Scheme:            scheme,
+				RestrictNamespace: true,
+			}
+		})
+
+		It("Should apply objects to the namespace of the Application", func() {
+			object := manifest("Deployment", "apps/v1", "")
+
+			Expect(reconciler.prepareManifest(context.Background(), application, object, false, logf.Log)).Should(Succeed())
+			Expect(object.GetNamespace()).Should(Equal("apps"))
+		})
+
+		It("Should refuse objects in other namespaces", func() {
+			Expect(reconciler.prepareManifest(context.Background(), application, manifest("Deployment", "apps/v1", "kube-system"), false, logf.Log)).ShouldNot(Succeed())
+
+			application.Spec.TargetNamespace = "kube-system"
+			Expect(reconciler.prepareManifest(context.Background(), application, manifest("Deployment", "apps/v1", ""), false, logf.Log)).ShouldNot(Succeed())
+		})
+
+		It("Should refuse cluster-scoped objects", func() {
+			Expect(reconciler.prepareManifest(context.Background(), application, manifest("ClusterRoleBinding", "rbac.authorization.k8s.io/v1", ""), false, logf.Log)).ShouldNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,149 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// SyncWaveAnnotation puts an object into a sync wave, 0 unless set. Waves are applied in ascending order and every
+// wave has to be healthy before the next one is applied.
+const SyncWaveAnnotation = "gitops.potato.io/sync-wave"
+
+// kindOrder is the order kinds are applied in within a sync wave, so objects are only created after what they depend
+// on. Kinds not listed, e.g. custom resources, are applied last.
+var kindOrder = []string{
+	"Namespace",
+	"ResourceQuota",
+	"LimitRange",
+	"PriorityClass",
+	"CustomResourceDefinition",
+	"StorageClass",
+	"ServiceAccount",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"ConfigMap",
+	"Secret",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"Service",
+	"Pod",
+	"ReplicaSet",
+	"Deployment",
+	"StatefulSet",
+	"DaemonSet",
+	"Job",
+	"CronJob",
+	"HorizontalPodAutoscaler",
+	"PodDisruptionBudget",
+	"NetworkPolicy",
+	"IngressClass",
+	"Ingress",
+	"APIService",
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+}
+
+// kindRank returns the position of the kind in kindOrder, or the end of it for unknown kinds.
+func kindRank(kind string) int {
+	for i, ordered := range kindOrder {
+		if ordered == kind {
+			return i
+		}
+	}
+
+	return len(kindOrder)
+}
+
+// syncWave returns the sync wave of an object.
+func syncWave(object *unstructured.Unstructured) (int, error) {
+	value, ok := object.GetAnnotations()[SyncWaveAnnotation]
+	if !ok {
+		return 0, nil
+	}
+
+	wave, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation %q on %s: %w", SyncWaveAnnotation, value, resourceReferenceString(resourceReferenceOf(object)), err)
+	}
+
+	return wave, nil
+}
+
+// orderManifests sorts the objects into the order they are applied in: by sync wave, then by kind. Objects of the same
+// wave and kind keep the order they were rendered in.
+func orderManifests(objects []*unstructured.Unstructured) error {
+	waves := map[*unstructured.Unstructured]int{}
+	for _, object := range objects {
+		wave, err := syncWave(object)
+		if err != nil {
+			return err
+		}
+
+		waves[object] = wave
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		if waves[objects[i]] != waves[objects[j]] {
+			return waves[objects[i]] < waves[objects[j]]
+		}
+
+		return kindRank(objects[i].GetKind()) < kindRank(objects[j].GetKind())
+	})
+
+	return nil
+}
+
+// reverseApplyOrder sorts live objects into the order they are deleted in, the reverse of orderManifests: by descending
+// sync wave, then by kind in reverse. Objects of the same wave and kind keep their order. Invalid sync waves count as
+// wave 0, as the objects have to be deleted regardless.
+func reverseApplyOrder(objects []*unstructured.Unstructured) {
+	waves := map[*unstructured.Unstructured]int{}
+	for _, object := range objects {
+		waves[object], _ = syncWave(object)
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		if waves[objects[i]] != waves[objects[j]] {
+			return waves[objects[i]] > waves[objects[j]]
+		}
+
+		return kindRank(objects[i].GetKind()) > kindRank(objects[j].GetKind())
+	})
+}
+
+// waveFailed tells whether a sync wave that is not healthy fails the sync instead of being waited for. Degraded objects
+// and objects still progressing after the health timeout passed since the last change are not expected to recover by
+// waiting.
+func waveFailed(application *gitopsv1.Application, health string) bool {
+	if health == gitopsv1.HealthDegraded {
+		return true
+	}
+
+	changed := application.Status.LastChangeTime
+
+	return changed != nil && time.Since(changed.Time) >= healthTimeout(application)
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Ordering manifests", func() {
+	manifest := func(apiVersion, kind, name string, annotations map[string]string) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{}
+		object.SetAPIVersion(apiVersion)
+		object.SetKind(kind)
+		object.SetName(name)
+		object.SetAnnotations(annotations)
+		return object
+	}
+
+	names := func(objects []*unstructured.Unstructured) []string {
+		var result []string
+		for _, object := range objects {
+			result = append(result, object.GetName())
+		}
+		return result
+	}
+
+	Context("When the manifests have no sync waves", func() {
+		It("Should apply dependencies before the objects that need them", func() {
+			objects := []*unstructured.Unstructured{
+				manifest("example.com/v1", "Cowsay", "custom", nil),
+				manifest("apps/v1", "Deployment", "deployment", nil),
+				manifest("v1", "Service", "service", nil),
+				manifest("v1", "ConfigMap", "config", nil),
+				manifest("rbac.authorization.k8s.io/v1", "RoleBinding", "binding", nil),
+				manifest("v1", "ServiceAccount", "account", nil),
+				manifest("apiextensions.k8s.io/v1", "CustomResourceDefinition", "crd", nil),
+				manifest("v1", "Namespace", "namespace", nil),
+			}
+
+			Expect(orderManifests(objects)).Should(Succeed())
+			Expect(names(objects)).Should(Equal([]string{"namespace", "crd", "account", "binding", "config", "service", "deployment", "custom"}))
+		})
+
+		It("Should keep the rendered order of objects of the same kind", func() {
+			objects := []*unstructured.Unstructured{
+				manifest("apps/v1", "Deployment", "b", nil),
+				manifest("v1", "ConfigMap", "config", nil),
+				manifest("apps/v1", "Deployment", "a", nil),
+			}
+
+			Expect(orderManifests(objects)).Should(Succeed())
+			Expect(names(objects)).Should(Equal([]string{"config", "b", "a"}))
+		})
+	})
+
+	Context("When the manifests have sync waves", func() {
+		It("Should apply the waves in ascending order before ordering by kind", func() {
+			objects := []*unstructured.Unstructured{
+				manifest("v1", "Namespace", "late", map[string]string{SyncWaveAnnotation: "1"}),
+				manifest("apps/v1", "Deployment", "default", nil),
+				manifest("batch/v1", "Job", "early", map[string]string{SyncWaveAnnotation: "-1"}),
+			}
+
+			Expect(orderManifests(objects)).Should(Succeed())
+			Expect(names(objects)).Should(Equal([]string{"early", "default", "late"}))
+		})
+
+		It("Should reject a sync wave that is not a number", func() {
+			objects := []*unstructured.Unstructured{
+				manifest("v1", "ConfigMap", "config", map[string]string{SyncWaveAnnotation: "first"}),
+			}
+
+			Expect(orderManifests(objects)).ShouldNot(Succeed())
+		})
+	})
+
+	Context("When a sync wave is not healthy", func() {
+		var application *gitopsv1.Application
+
+		BeforeEach(func() {
+			changed := metav1.NewTime(time.Now().Add(-time.Minute))
+			application = &gitopsv1.Application{Status: gitopsv1.ApplicationStatus{LastChangeTime: &changed}}
+		})
+
+		It("Should wait for a progressing wave within the health timeout", func() {
+			Expect(waveFailed(application, gitopsv1.HealthProgressing)).Should(BeFalse())
+		})
+
+		It("Should fail the sync on a degraded wave", func() {
+			Expect(waveFailed(application, gitopsv1.HealthDegraded)).Should(BeTrue())
+		})
+
+		It("Should fail the sync once the health timeout passed", func() {
+			application.Spec.HealthTimeout = &metav1.Duration{Duration: 30 * time.Second}
+
+			Expect(waveFailed(application, gitopsv1.HealthProgressing)).Should(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,147 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// PruneAnnotation can be set to PruneDisabled on an object to keep it in the cluster when it is removed from the
+// repository of the Application
+const PruneAnnotation = "gitops.potato.io/prune"
+
+// PruneDisabled is the value of PruneAnnotation that opts an object out of pruning
+const PruneDisabled = "disabled"
+
+// resourceReferenceOf returns the inventory entry for an applied object.
+func resourceReferenceOf(object *unstructured.Unstructured) gitopsv1.ResourceReference {
+	groupVersionKind := object.GroupVersionKind()
+
+	return gitopsv1.ResourceReference{
+		Group:     groupVersionKind.Group,
+		Version:   groupVersionKind.Version,
+		Kind:      groupVersionKind.Kind,
+		Namespace: object.GetNamespace(),
+		Name:      object.GetName(),
+	}
+}
+
+// resourceReferenceString formats an inventory entry for logs and messages.
+func resourceReferenceString(ref gitopsv1.ResourceReference) string {
+	return schema.GroupKind{Group: ref.Group, Kind: ref.Kind}.String() + " " +
+		types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}.String()
+}
+
+// sameResource compares inventory entries ignoring the version, so bumping the apiVersion of a manifest does not prune
+// the object it describes.
+func sameResource(a, b gitopsv1.ResourceReference) bool {
+	return a.Group == b.Group && a.Kind == b.Kind && a.Namespace == b.Namespace && a.Name == b.Name
+}
+
+// resourceGone tells whether getting or deleting an object failed because it does not exist anymore, including when
+// its kind is not served anymore, e.g. because its CustomResourceDefinition was deleted.
+func resourceGone(err error) bool {
+	return errors.IsNotFound(err) || meta.IsNoMatchError(err)
+}
+
+// staleResources returns the entries of the previous inventory that are missing from the current one.
+func staleResources(previous, current []gitopsv1.ResourceReference) []gitopsv1.ResourceReference {
+	var stale []gitopsv1.ResourceReference
+
+	for _, old := range previous {
+		found := false
+		for _, ref := range current {
+			if sameResource(old, ref) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			stale = append(stale, old)
+		}
+	}
+
+	return stale
+}
+
+// pruneResources deletes the objects of the previous inventory that are no longer rendered from the repository at the
+// revision, in the reverse of the order they are applied in, so e.g. custom resources go before their
+// CustomResourceDefinition. Objects opted out with PruneAnnotation are left in the cluster. The returned slice holds the
+// references that could not be pruned yet and have to be kept in the inventory to be retried.
+func (r *ApplicationReconciler) pruneResources(ctx context.Context, application *gitopsv1.Application, revision string, stale []gitopsv1.ResourceReference, logger logr.Logger) ([]gitopsv1.ResourceReference, error) {
+	var remaining []gitopsv1.ResourceReference
+	var lastErr error
+
+	// The inventory is in apply order, objects of the same wave and kind are deleted in reverse of it
+	var objects []*unstructured.Unstructured
+
+	for i := len(stale) - 1; i >= 0; i-- {
+		ref := stale[i]
+
+		object, err := r.getResource(ctx, ref)
+		if err != nil {
+			if resourceGone(err) {
+				logger.Info("Object to prune is already gone: " + resourceReferenceString(ref))
+				continue
+			}
+
+			logger.Error(err, "Failed to get object to prune: "+resourceReferenceString(ref))
+			remaining = append(remaining, ref)
+			lastErr = err
+			continue
+		}
+
+		if object.GetAnnotations()[PruneAnnotation] == PruneDisabled {
+			logger.Info("Object has pruning disabled, leaving it in place: " + resourceReferenceString(ref))
+			continue
+		}
+
+		objects = append(objects, object)
+	}
+
+	reverseApplyOrder(objects)
+
+	for _, object := range objects {
+		ref := resourceReferenceOf(object)
+
+		logger.Info("Pruning object removed from the repository: " + resourceReferenceString(ref))
+
+		propagationPolicy := metav1.DeletePropagationBackground
+		if err := r.Delete(ctx, object, &client.DeleteOptions{PropagationPolicy: &propagationPolicy}); err != nil && !resourceGone(err) {
+			logger.Error(err, "Failed to prune object: "+resourceReferenceString(ref))
+			remaining = append(remaining, ref)
+			lastErr = err
+			continue
+		}
+
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, gitopsv1.PrunedReason, "Pruned %s removed at revision %s", resourceReferenceString(ref), revision)
+	}
+
+	return remaining, lastErr
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Pruning", func() {
+	deployment := gitopsv1.ResourceReference{Group: "apps", Version: "v1", Kind: "Deployment", Namespace: "default", Name: "cowsay"}
+	service := gitopsv1.ResourceReference{Version: "v1", Kind: "Service", Namespace: "default", Name: "cowsay"}
+
+	Context("When comparing the previous and the current inventory", func() {
+		It("Should report objects missing from the current inventory as stale", func() {
+			stale := staleResources([]gitopsv1.ResourceReference{deployment, service}, []gitopsv1.ResourceReference{deployment})
+
+			Expect(stale).Should(Equal([]gitopsv1.ResourceReference{service}))
+		})
+
+		It("Should not report objects whose apiVersion changed as stale", func() {
+			upgraded := deployment
+			upgraded.Version = "v2"
+
+			Expect(staleResources([]gitopsv1.ResourceReference{deployment}, []gitopsv1.ResourceReference{upgraded})).Should(BeEmpty())
+		})
+	})
+
+	Context("When pruning stale objects", func() {
+		var reconciler *ApplicationReconciler
+		var deleted []string
+
+		namespace := gitopsv1.ResourceReference{Version: "v1", Kind: "Namespace", Name: "apps"}
+		early := gitopsv1.ResourceReference{Version: "v1", Kind: "ConfigMap", Namespace: "apps", Name: "early"}
+		late := gitopsv1.ResourceReference{Version: "v1", Kind: "ConfigMap", Namespace: "apps", Name: "late"}
+		// The CustomResourceDefinition of the kind is gone, so the kind is not served anymore
+		crontab := gitopsv1.ResourceReference{Group: "stable.example.com", Version: "v1", Kind: "CronTab", Namespace: "apps", Name: "backup"}
+
+		BeforeEach(func() {
+			deleted = nil
+
+			scheme := runtime.NewScheme()
+			Expect(corev1.AddToScheme(scheme)).Should(Succeed())
+
+			mapper := meta.NewDefaultRESTMapper(nil)
+			mapper.Add(corev1.SchemeGroupVersion.WithKind("Namespace"), meta.RESTScopeRoot)
+			mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+
+			reconciler = &ApplicationReconciler{
+				Client: fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithObjects(
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}},
+					&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "early", Namespace: "apps"}},
+					&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "late", Namespace: "apps", Annotations: map[string]string{SyncWaveAnnotation: "1"}}},
+				).WithInterceptorFuncs(interceptor.Funcs{
+					// Unlike the real client, the fake one does not map the kind before getting an object
+					Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, object client.Object, opts ...client.GetOption) error {
+						groupVersionKind := object.GetObjectKind().GroupVersionKind()
+						if _, err := mapper.RESTMapping(groupVersionKind.GroupKind(), groupVersionKind.Version); err != nil {
+							return err
+						}
+						return c.Get(ctx, key, object, opts...)
+					},
+					Delete: func(ctx context.Context, c client.WithWatch, object client.Object, opts ...client.DeleteOption) error {
+						deleted = append(deleted, object.GetName())
+						return c.Delete(ctx, object, opts...)
+					},
+				}).Build(),
+				Scheme:   scheme,
+				Recorder: record.NewFakeRecorder(10),
+			}
+		})
+
+		It("Should delete them in reverse apply order", func() {
+			remaining, err := reconciler.pruneResources(context.Background(), &gitopsv1.Application{}, "0123456789abcdef", []gitopsv1.ResourceReference{namespace, early, late}, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(remaining).Should(BeEmpty())
+
+			Expect(deleted).Should(Equal([]string{"late", "early", "apps"}))
+		})
+
+		It("Should treat objects of kinds that are not served anymore as gone", func() {
+			remaining, err := reconciler.pruneResources(context.Background(), &gitopsv1.Application{}, "0123456789abcdef", []gitopsv1.ResourceReference{crontab, early}, logf.Log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(remaining).Should(BeEmpty())
+
+			Expect(deleted).Should(Equal([]string{"early"}))
+		})
+	})
+})
@@ -0,0 +1,376 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// ReceiverTokenSecretKey is the key of the receiver Secret holding the token webhook signatures are validated with
+const ReceiverTokenSecretKey = "token"
+
+// maxPayloadSize limits the size of the webhook payloads read by the Receiver
+const maxPayloadSize = 10 << 20
+
+// Receiver serves an HTTP endpoint for push webhooks of Git providers and triggers a sync of the Applications following
+// the pushed repository and ref right away, instead of waiting for their next interval. Each provider has its own path:
+// /github, /gitlab, /gitea and /generic.
+type Receiver struct {
+	client.Client
+
+	// Address the receiver listens on
+	Address string
+	// SecretName is the Secret holding the token under ReceiverTokenSecretKey
+	SecretName types.NamespacedName
+	// Events is where the Applications to sync are sent to, the ApplicationReconciler watches it
+	Events chan<- event.GenericEvent
+}
+
+// pushEvent is what the Receiver needs to know about a push: the pushed repository under any of its URLs and the ref.
+type pushEvent struct {
+	URLs []string
+	Ref  string
+}
+
+// FailedToValidateWebhook is returned for webhooks whose signature or token does not match the receiver Secret
+type FailedToValidateWebhook struct {
+	Err error
+}
+
+func (e *FailedToValidateWebhook) Error() string {
+	return "Failed to validate webhook: " + e.Err.Error()
+}
+
+func (e *FailedToValidateWebhook) Unwrap() error {
+	return e.Err
+}
+
+// Start implements manager.Runnable, serving the webhook endpoint until the context is cancelled.
+func (r *Receiver) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("receiver")
+
+	mux := http.NewServeMux()
+	for provider, parse := range map[string]func(*http.Request, []byte, []byte) (*pushEvent, error){
+		"github":  parseGitHubWebhook,
+		"gitlab":  parseGitLabWebhook,
+		"gitea":   parseGiteaWebhook,
+		"generic": parseGenericWebhook,
+	} {
+		mux.Handle("/"+provider, r.handler(ctx, parse, logger.WithValues("provider", provider)))
+	}
+
+	server := &http.Server{Addr: r.Address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error(err, "Failed to shut down webhook receiver")
+		}
+	}()
+
+	logger.Info("Serving webhook receiver on: " + r.Address)
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// handler validates and parses a webhook with parse and enqueues the Applications the push matters to.
+func (r *Receiver) handler(ctx context.Context, parse func(*http.Request, []byte, []byte) (*pushEvent, error), logger logr.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+		if err != nil {
+			http.Error(w, "failed to read payload", http.StatusBadRequest)
+			return
+		}
+
+		secret := &corev1.Secret{}
+		if err := r.Get(req.Context(), r.SecretName, secret); err != nil {
+			logger.Error(err, "Failed to get receiver secret: "+r.SecretName.String())
+			http.Error(w, "failed to get receiver secret", http.StatusInternalServerError)
+			return
+		}
+
+		push, err := parse(req, payload, secret.Data[ReceiverTokenSecretKey])
+		if err != nil {
+			var validationErr *FailedToValidateWebhook
+			if errors.As(err, &validationErr) {
+				logger.Info("Rejected webhook: " + err.Error())
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			logger.Info("Failed to parse webhook: " + err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Pings and other events that are not pushes
+		if push == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		applications := &gitopsv1.ApplicationList{}
+		if err := r.List(req.Context(), applications); err != nil {
+			logger.Error(err, "Failed to list Applications")
+			http.Error(w, "failed to list applications", http.StatusInternalServerError)
+			return
+		}
+
+		count := 0
+		for i := range applications.Items {
+			application := &applications.Items[i]
+			if !push.matches(application) {
+				continue
+			}
+
+			logger.Info("Triggering sync of Application: " + client.ObjectKeyFromObject(application).String() + " on push to: " + push.Ref)
+
+			select {
+			case r.Events <- event.GenericEvent{Object: application}:
+				count++
+			case <-ctx.Done():
+				http.Error(w, "receiver is shutting down", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintf(w, "triggered sync of %d applications\n", count)
+	})
+}
+
+// matches tells whether the push changes what the Application checks out. Branches are matched by name, any pushed tag
+// may be the one a tag or semver range resolves to, and pinned commits never change.
+func (p *pushEvent) matches(application *gitopsv1.Application) bool {
+	repository := normalizeRepositoryURL(application.Spec.Repository)
+	if repository == "" {
+		return false
+	}
+
+	found := false
+	for _, url := range p.URLs {
+		if normalizeRepositoryURL(url) == repository {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return false
+	}
+
+	ref := application.Spec.Ref
+	switch {
+	case ref == nil || p.Ref == "":
+		return true
+	case ref.Branch != "":
+		return p.Ref == "refs/heads/"+ref.Branch || p.Ref == ref.Branch
+	case ref.Tag != "" || ref.SemVer != "":
+		return strings.HasPrefix(p.Ref, "refs/tags/")
+	}
+
+	return false
+}
+
+// normalizeRepositoryURL reduces a repository URL to its host and path, so the HTTPS and SSH URLs of a repository and
+// their variants with and without the .git suffix compare equal.
+func normalizeRepositoryURL(url string) string {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil || endpoint.Host == "" {
+		return ""
+	}
+
+	path := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), ".git")
+
+	return strings.ToLower(endpoint.Host) + "/" + path
+}
+
+// validateHMAC checks a hex encoded HMAC-SHA256 signature of the payload.
+func validateHMAC(payload, token []byte, signature string) error {
+	if len(token) == 0 {
+		return &FailedToValidateWebhook{Err: fmt.Errorf("receiver secret has no %s", ReceiverTokenSecretKey)}
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return &FailedToValidateWebhook{Err: fmt.Errorf("malformed signature")}
+	}
+
+	mac := hmac.New(sha256.New, token)
+	mac.Write(payload)
+
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return &FailedToValidateWebhook{Err: fmt.Errorf("signature mismatch")}
+	}
+
+	return nil
+}
+
+// gitHubPayload is the part of GitHub and Gitea push payloads the Receiver needs
+type gitHubPayload struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+func (p *gitHubPayload) pushEvent() *pushEvent {
+	return &pushEvent{URLs: []string{p.Repository.CloneURL, p.Repository.SSHURL, p.Repository.HTMLURL}, Ref: p.Ref}
+}
+
+func parseGitHubWebhook(req *http.Request, payload, token []byte) (*pushEvent, error) {
+	signature := req.Header.Get("X-Hub-Signature-256")
+	if !strings.HasPrefix(signature, "sha256=") {
+		return nil, &FailedToValidateWebhook{Err: fmt.Errorf("missing X-Hub-Signature-256 header")}
+	}
+
+	if err := validateHMAC(payload, token, strings.TrimPrefix(signature, "sha256=")); err != nil {
+		return nil, err
+	}
+
+	if req.Header.Get("X-GitHub-Event") != "push" {
+		return nil, nil
+	}
+
+	push := &gitHubPayload{}
+	if err := json.Unmarshal(payload, push); err != nil {
+		return nil, fmt.Errorf("failed to decode push payload: %w", err)
+	}
+
+	return push.pushEvent(), nil
+}
+
+func parseGiteaWebhook(req *http.Request, payload, token []byte) (*pushEvent, error) {
+	signature := req.Header.Get("X-Gitea-Signature")
+	if signature == "" {
+		return nil, &FailedToValidateWebhook{Err: fmt.Errorf("missing X-Gitea-Signature header")}
+	}
+
+	if err := validateHMAC(payload, token, signature); err != nil {
+		return nil, err
+	}
+
+	if req.Header.Get("X-Gitea-Event") != "push" {
+		return nil, nil
+	}
+
+	push := &gitHubPayload{}
+	if err := json.Unmarshal(payload, push); err != nil {
+		return nil, fmt.Errorf("failed to decode push payload: %w", err)
+	}
+
+	return push.pushEvent(), nil
+}
+
+// gitLabPayload is the part of GitLab push and tag push payloads the Receiver needs
+type gitLabPayload struct {
+	Ref     string `json:"ref"`
+	Project struct {
+		HTTPURL string `json:"git_http_url"`
+		SSHURL  string `json:"git_ssh_url"`
+		WebURL  string `json:"web_url"`
+	} `json:"project"`
+}
+
+// parseGitLabWebhook checks the secret token GitLab sends as is, as it does not sign its payloads.
+func parseGitLabWebhook(req *http.Request, payload, token []byte) (*pushEvent, error) {
+	if len(token) == 0 {
+		return nil, &FailedToValidateWebhook{Err: fmt.Errorf("receiver secret has no %s", ReceiverTokenSecretKey)}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Gitlab-Token")), token) != 1 {
+		return nil, &FailedToValidateWebhook{Err: fmt.Errorf("token mismatch")}
+	}
+
+	switch req.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+	default:
+		return nil, nil
+	}
+
+	push := &gitLabPayload{}
+	if err := json.Unmarshal(payload, push); err != nil {
+		return nil, fmt.Errorf("failed to decode push payload: %w", err)
+	}
+
+	return &pushEvent{URLs: []string{push.Project.HTTPURL, push.Project.SSHURL, push.Project.WebURL}, Ref: push.Ref}, nil
+}
+
+// genericPayload is the payload accepted by the generic endpoint, e.g. from CI pipelines. An empty ref triggers all
+// Applications of the repository.
+type genericPayload struct {
+	Repository string `json:"repository"`
+	Ref        string `json:"ref"`
+}
+
+func parseGenericWebhook(req *http.Request, payload, token []byte) (*pushEvent, error) {
+	signature := req.Header.Get("X-Signature")
+	if !strings.HasPrefix(signature, "sha256=") {
+		return nil, &FailedToValidateWebhook{Err: fmt.Errorf("missing X-Signature header")}
+	}
+
+	if err := validateHMAC(payload, token, strings.TrimPrefix(signature, "sha256=")); err != nil {
+		return nil, err
+	}
+
+	push := &genericPayload{}
+	if err := json.Unmarshal(payload, push); err != nil {
+		return nil, fmt.Errorf("failed to decode push payload: %w", err)
+	}
+
+	if push.Repository == "" {
+		return nil, fmt.Errorf("payload has no repository")
+	}
+
+	return &pushEvent{URLs: []string{push.Repository}, Ref: push.Ref}, nil
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Webhook receiver", func() {
+	token := []byte("potato")
+
+	sign := func(payload string) string {
+		mac := hmac.New(sha256.New, token)
+		mac.Write([]byte(payload))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	Context("When receiving a GitHub push", func() {
+		payload := `{"ref":"refs/heads/master","repository":{"clone_url":"https://github.com/uvegla/potato-application-2.git","ssh_url":"git@github.com:uvegla/potato-application-2.git"}}`
+
+		It("Should accept a valid signature", func() {
+			req := httptest.NewRequest("POST", "/github", strings.NewReader(payload))
+			req.Header.Set("X-GitHub-Event", "push")
+			req.Header.Set("X-Hub-Signature-256", sign(payload))
+
+			push, err := parseGitHubWebhook(req, []byte(payload), token)
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(push.Ref).Should(Equal("refs/heads/master"))
+		})
+
+		It("Should reject an invalid signature", func() {
+			req := httptest.NewRequest("POST", "/github", strings.NewReader(payload))
+			req.Header.Set("X-GitHub-Event", "push")
+			req.Header.Set("X-Hub-Signature-256", sign(payload+" "))
+
+			_, err := parseGitHubWebhook(req, []byte(payload), token)
+
+			Expect(err).Should(BeAssignableToTypeOf(&FailedToValidateWebhook{}))
+		})
+	})
+
+	Context("When matching a push to Applications", func() {
+		push := &pushEvent{URLs: []string{"git@github.com:uvegla/potato-application-2.git"}, Ref: "refs/heads/master"}
+
+		application := func(repository string, ref gitopsv1.GitReference) *gitopsv1.Application {
+			return &gitopsv1.Application{Spec: gitopsv1.ApplicationSpec{Repository: repository, Ref: &ref}}
+		}
+
+		It("Should match the HTTPS URL of the pushed repository and branch", func() {
+			Expect(push.matches(application("https://github.com/uvegla/potato-application-2", gitopsv1.GitReference{Branch: "master"}))).Should(BeTrue())
+		})
+
+		It("Should not match other branches or repositories", func() {
+			Expect(push.matches(application("https://github.com/uvegla/potato-application-2", gitopsv1.GitReference{Branch: "dev"}))).Should(BeFalse())
+			Expect(push.matches(application("https://github.com/uvegla/potato-application-1", gitopsv1.GitReference{Branch: "master"}))).Should(BeFalse())
+		})
+	})
+})
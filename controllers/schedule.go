@@ -0,0 +1,119 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// DefaultInterval is how often Applications are synced if neither they nor the controller say otherwise
+const DefaultInterval = time.Minute
+
+// DefaultRetryInterval is the delay before retrying the first failed sync of an Application
+const DefaultRetryInterval = 10 * time.Second
+
+// WaitInterval is how often a sync waiting for a sync wave to become healthy or for hooks to complete checks on them
+const WaitInterval = 5 * time.Second
+
+// jitterFactor spreads the syncs of Applications with the same interval, so they do not hit the Git remotes at once
+const jitterFactor = 0.1
+
+// interval returns how often the Application is synced.
+func (r *ApplicationReconciler) interval(application *gitopsv1.Application) time.Duration {
+	if application.Spec.Interval != nil {
+		return application.Spec.Interval.Duration
+	}
+
+	if r.DefaultInterval > 0 {
+		return r.DefaultInterval
+	}
+
+	return DefaultInterval
+}
+
+// retryDelay returns the delay before retrying after the given number of consecutive failures. The retry interval is
+// doubled with every failure, but never exceeds the interval, unless the retry interval itself is longer.
+func (r *ApplicationReconciler) retryDelay(application *gitopsv1.Application, failures int) time.Duration {
+	delay := DefaultRetryInterval
+	if application.Spec.RetryInterval != nil {
+		delay = application.Spec.RetryInterval.Duration
+	}
+
+	limit := r.interval(application)
+	if delay > limit {
+		return delay
+	}
+
+	for i := 1; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+
+	if delay > limit {
+		return limit
+	}
+
+	return delay
+}
+
+// requeueAfter returns when the Application is synced next, depending on the outcome of the last sync. Stalled
+// Applications wait for the next interval, as retrying sooner would not help, while a sync waiting for a sync wave
+// or hooks continues shortly.
+func (r *ApplicationReconciler) requeueAfter(application *gitopsv1.Application, failed, stalled bool) time.Duration {
+	if waiting(application) {
+		return wait.Jitter(WaitInterval, jitterFactor)
+	}
+
+	if failed && !stalled {
+		return wait.Jitter(r.retryDelay(application, application.Status.Failures), jitterFactor)
+	}
+
+	return wait.Jitter(r.interval(application), jitterFactor)
+}
+
+// fetchDue tells whether the repository of the Application has to be fetched: the interval passed since the last fetch,
+// the Application changed, a sync is requested or triggered by a webhook, or the last fetch failed. Other syncs, e.g.
+// ones continuing a sync that waits or triggered by changes to owned objects, use the revision checked out last.
+func (r *ApplicationReconciler) fetchDue(application *gitopsv1.Application, triggered bool) bool {
+	status := application.Status
+	synced := meta.FindStatusCondition(status.Conditions, gitopsv1.SyncedCondition)
+
+	return triggered ||
+		status.LastFetchTime == nil ||
+		time.Since(status.LastFetchTime.Time) >= r.interval(application) ||
+		application.Generation != status.ObservedGeneration ||
+		status.Repository != application.Spec.Repository ||
+		status.Ref != application.Spec.Ref.String() ||
+		application.Annotations[ReconcileRequestAnnotation] != status.LastHandledReconcileAt ||
+		(synced != nil && synced.Reason == gitopsv1.GitOperationFailedReason)
+}
+
+// waiting returns whether the last sync waits for a sync wave to become healthy or for hooks to complete.
+func waiting(application *gitopsv1.Application) bool {
+	for _, conditionType := range []string{gitopsv1.SyncedCondition, gitopsv1.ReadyCondition} {
+		condition := meta.FindStatusCondition(application.Status.Conditions, conditionType)
+		if condition != nil && (condition.Reason == gitopsv1.WaitingForWaveReason || condition.Reason == gitopsv1.WaitingForHookReason) {
+			return true
+		}
+	}
+
+	return hooksRunning(application)
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Sync schedule", func() {
+	reconciler := &ApplicationReconciler{DefaultInterval: 5 * time.Minute}
+
+	Context("When retrying failed syncs", func() {
+		It("Should double the retry interval on every consecutive failure", func() {
+			application := &gitopsv1.Application{}
+			application.Spec.RetryInterval = &metav1.Duration{Duration: 30 * time.Second}
+
+			Expect(reconciler.retryDelay(application, 1)).Should(Equal(30 * time.Second))
+			Expect(reconciler.retryDelay(application, 2)).Should(Equal(time.Minute))
+			Expect(reconciler.retryDelay(application, 4)).Should(Equal(4 * time.Minute))
+		})
+
+		It("Should not back off beyond the interval", func() {
+			application := &gitopsv1.Application{}
+			application.Spec.Interval = &metav1.Duration{Duration: 2 * time.Minute}
+
+			Expect(reconciler.retryDelay(application, 10)).Should(Equal(2 * time.Minute))
+		})
+	})
+
+	Context("When scheduling the next sync", func() {
+		It("Should jitter the interval by at most 10 percent", func() {
+			application := &gitopsv1.Application{}
+
+			requeueAfter := reconciler.requeueAfter(application, false, false)
+
+			Expect(requeueAfter).Should(BeNumerically(">=", 5*time.Minute))
+			Expect(requeueAfter).Should(BeNumerically("<=", 5*time.Minute+30*time.Second))
+		})
+	})
+
+	Context("When deciding whether to fetch the repository", func() {
+		var application *gitopsv1.Application
+
+		BeforeEach(func() {
+			fetched := metav1.NewTime(time.Now().Add(-time.Minute))
+			application = &gitopsv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Generation: 1},
+				Spec:       gitopsv1.ApplicationSpec{Repository: "https://github.com/uvegla/application-2", Ref: &gitopsv1.GitReference{Branch: "main"}},
+				Status: gitopsv1.ApplicationStatus{
+					ObservedGeneration: 1,
+					Repository:         "https://github.com/uvegla/application-2",
+					Ref:                "branch/main",
+					LastFetchTime:      &fetched,
+				},
+			}
+		})
+
+		It("Should not fetch again before the interval passed", func() {
+			Expect(reconciler.fetchDue(application, false)).Should(BeFalse())
+		})
+
+		It("Should fetch once the interval passed", func() {
+			application.Status.LastFetchTime.Time = time.Now().Add(-6 * time.Minute)
+
+			Expect(reconciler.fetchDue(application, false)).Should(BeTrue())
+		})
+
+		It("Should fetch right away on a webhook, a requested sync or a change to the Application", func() {
+			Expect(reconciler.fetchDue(application, true)).Should(BeTrue())
+
+			requested := application.DeepCopy()
+			requested.Annotations = map[string]string{ReconcileRequestAnnotation: "now"}
+			Expect(reconciler.fetchDue(requested, false)).Should(BeTrue())
+
+			changed := application.DeepCopy()
+			changed.Generation = 2
+			Expect(reconciler.fetchDue(changed, false)).Should(BeTrue())
+		})
+	})
+})
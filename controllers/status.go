@@ -0,0 +1,123 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+// setCondition sets a condition on the status of the Application, keeping the transition time if the status did not
+// change.
+func setCondition(application *gitopsv1.Application, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&application.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: application.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// markSynced records a successful sync of revision.
+func markSynced(application *gitopsv1.Application, revision string) {
+	now := metav1.Now()
+
+	application.Status.LastAppliedRevision = revision
+	application.Status.LastSyncTime = &now
+
+	message := "Applied revision: " + revision
+
+	setCondition(application, gitopsv1.SyncedCondition, metav1.ConditionTrue, gitopsv1.SyncSucceededReason, message)
+	setCondition(application, gitopsv1.StalledCondition, metav1.ConditionFalse, gitopsv1.SyncSucceededReason, message)
+	setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionTrue, gitopsv1.SyncSucceededReason, message)
+}
+
+// markFailed records a failed sync. A stalled Application cannot make progress until its spec or repository changes,
+// while other failures are expected to go away by retrying.
+func markFailed(application *gitopsv1.Application, reason string, err error, stalled bool) {
+	message := err.Error()
+
+	setCondition(application, gitopsv1.SyncedCondition, metav1.ConditionFalse, reason, message)
+	setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionFalse, reason, message)
+
+	if stalled {
+		setCondition(application, gitopsv1.StalledCondition, metav1.ConditionTrue, reason, message)
+	} else {
+		setCondition(application, gitopsv1.StalledCondition, metav1.ConditionFalse, reason, message)
+	}
+}
+
+// markHealth records the aggregated health of the applied objects. Objects that are still progressing after the health
+// timeout passed since the last change make the Application unhealthy, like degraded ones, which also makes it not
+// Ready.
+func markHealth(application *gitopsv1.Application, health, message string, timeout time.Duration) {
+	switch health {
+	case gitopsv1.HealthHealthy:
+		setCondition(application, gitopsv1.HealthyCondition, metav1.ConditionTrue, gitopsv1.HealthyReason, "All applied objects are healthy")
+		return
+	case gitopsv1.HealthDegraded:
+		setCondition(application, gitopsv1.HealthyCondition, metav1.ConditionFalse, gitopsv1.HealthCheckFailedReason, message)
+	default:
+		changed := application.Status.LastChangeTime
+		if changed == nil || time.Since(changed.Time) < timeout {
+			setCondition(application, gitopsv1.HealthyCondition, metav1.ConditionUnknown, gitopsv1.ProgressingReason, message)
+			return
+		}
+
+		message = fmt.Sprintf("Not healthy %s after the last change: %s", timeout, message)
+		setCondition(application, gitopsv1.HealthyCondition, metav1.ConditionFalse, gitopsv1.HealthCheckFailedReason, message)
+	}
+
+	setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionFalse, gitopsv1.HealthCheckFailedReason, message)
+}
+
+// markWaiting records a sync that has to wait before it can continue, for a sync wave to become healthy or for hooks
+// to complete.
+func markWaiting(application *gitopsv1.Application, reason, message string) {
+	setCondition(application, gitopsv1.SyncedCondition, metav1.ConditionUnknown, reason, message)
+	setCondition(application, gitopsv1.StalledCondition, metav1.ConditionFalse, reason, message)
+	setCondition(application, gitopsv1.ReadyCondition, metav1.ConditionUnknown, reason, message)
+}
+
+// markSuspended records whether the reconciliation of the Application is suspended. The Suspended condition is only
+// added once the Application got suspended.
+func markSuspended(application *gitopsv1.Application, suspended bool) {
+	if suspended {
+		setCondition(application, gitopsv1.SuspendedCondition, metav1.ConditionTrue, gitopsv1.SuspendedReason, "Reconciliation is suspended")
+	} else if meta.FindStatusCondition(application.Status.Conditions, gitopsv1.SuspendedCondition) != nil {
+		setCondition(application, gitopsv1.SuspendedCondition, metav1.ConditionFalse, gitopsv1.ResumedReason, "Reconciliation is resumed")
+	}
+}
+
+// markProgressing initializes the conditions of an Application that has not been synced yet.
+func markProgressing(application *gitopsv1.Application) {
+	for _, conditionType := range []string{gitopsv1.ReadyCondition, gitopsv1.SyncedCondition} {
+		if meta.FindStatusCondition(application.Status.Conditions, conditionType) == nil {
+			setCondition(application, conditionType, metav1.ConditionUnknown, gitopsv1.ProgressingReason, "Sync in progress")
+		}
+	}
+
+	if meta.FindStatusCondition(application.Status.Conditions, gitopsv1.HealthyCondition) == nil {
+		setCondition(application, gitopsv1.HealthyCondition, metav1.ConditionUnknown, gitopsv1.HealthNotAssessedReason, "Health of the applied objects is not assessed")
+	}
+}
@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	gitopsv1 "github.com/uvegla/potato/api/v1"
+)
+
+var _ = Describe("Syncing", func() {
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "cowsay"}
+
+	var reconciler *ApplicationReconciler
+	var recorder *record.FakeRecorder
+	var source, cacheRoot string
+	var repository *git.Repository
+
+	// commit puts a ConfigMap with the message into the repository and returns the revision
+	commit := func(message string) string {
+		worktree, err := repository.Worktree()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		file := filepath.Join("kubernetes", "configmap.yaml")
+		Expect(os.MkdirAll(filepath.Join(source, "kubernetes"), 0755)).Should(Succeed())
+		Expect(os.WriteFile(filepath.Join(source, file), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cowsay\ndata:\n  message: "+message+"\n"), 0644)).Should(Succeed())
+		_, err = worktree.Add(file)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		hash, err := worktree.Commit("Say "+message, &git.CommitOptions{Author: &object.Signature{Name: "potato", When: time.Now()}})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		return hash.String()
+	}
+
+	// create adds the Application, changed by the given function, for the repository
+	create := func(change func(*gitopsv1.Application)) {
+		application := &gitopsv1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, Generation: 1},
+			Spec:       gitopsv1.ApplicationSpec{Repository: source, Ref: &gitopsv1.GitReference{Branch: "master"}},
+		}
+		change(application)
+
+		Expect(reconciler.Create(ctx, application)).Should(Succeed())
+	}
+
+	// update changes the spec or the metadata of the Application
+	update := func(change func(*gitopsv1.Application)) {
+		application := &gitopsv1.Application{}
+		Expect(reconciler.Get(ctx, key, application)).Should(Succeed())
+		change(application)
+
+		Expect(reconciler.Update(ctx, application)).Should(Succeed())
+	}
+
+	// reconcile syncs the Application and returns it as recorded afterwards
+	reconcile := func() *gitopsv1.Application {
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		application := &gitopsv1.Application{}
+		Expect(reconciler.Get(ctx, key, application)).Should(Succeed())
+
+		return application
+	}
+
+	// message returns the message of the live ConfigMap, or an empty one if it does not exist
+	message := func() string {
+		configMap := &corev1.ConfigMap{}
+		if err := reconciler.Get(ctx, key, configMap); err != nil {
+			Expect(errors.IsNotFound(err)).Should(BeTrue())
+			return ""
+		}
+
+		return configMap.Data["message"]
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		source, err = os.MkdirTemp("", "potato-source")
+		Expect(err).ShouldNot(HaveOccurred())
+		repository, err = git.PlainInit(source, false)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cacheRoot, err = os.MkdirTemp("", "potato-cache")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).Should(Succeed())
+		Expect(gitopsv1.AddToScheme(scheme)).Should(Succeed())
+
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+
+		recorder = record.NewFakeRecorder(100)
+
+		reconciler = &ApplicationReconciler{
+			Client: fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).
+				WithStatusSubresource(&gitopsv1.Application{}).
+				WithInterceptorFuncs(interceptor.Funcs{Patch: fakeApply}).Build(),
+			Scheme:   scheme,
+			Recorder: recorder,
+			Cache:    NewRepositoryCache(cacheRoot, 0),
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(source)).Should(Succeed())
+		Expect(os.RemoveAll(cacheRoot)).Should(Succeed())
+	})
+
+	Context("When the Application is suspended", func() {
+		It("Should neither fetch nor apply anything until it is resumed", func() {
+			revision := commit("moo")
+			create(func(application *gitopsv1.Application) { application.Spec.Suspend = true })
+
+			application := reconcile()
+			Expect(meta.IsStatusConditionTrue(application.Status.Conditions, gitopsv1.SuspendedCondition)).Should(BeTrue())
+			Expect(application.Status.LastFetchTime).Should(BeNil())
+			Expect(application.Status.LastAttemptedRevision).Should(BeEmpty())
+			Expect(reconciler.Cache.mirrorsDir()).ShouldNot(BeADirectory())
+			Expect(message()).Should(BeEmpty())
+
+			update(func(application *gitopsv1.Application) { application.Spec.Suspend = false })
+
+			application = reconcile()
+			suspended := meta.FindStatusCondition(application.Status.Conditions, gitopsv1.SuspendedCondition)
+			Expect(suspended.Status).Should(Equal(metav1.ConditionFalse))
+			Expect(suspended.Reason).Should(Equal(gitopsv1.ResumedReason))
+			Expect(application.Status.LastAppliedRevision).Should(Equal(revision))
+			Expect(message()).Should(Equal("moo"))
+		})
+	})
+
+	Context("When a sync is requested", func() {
+		It("Should record the handled request and only sync again for a new one", func() {
+			first := commit("moo")
+			create(func(application *gitopsv1.Application) {
+				application.Annotations = map[string]string{ReconcileRequestAnnotation: "1"}
+			})
+
+			application := reconcile()
+			Expect(application.Status.LastHandledReconcileAt).Should(Equal("1"))
+			Expect(application.Status.LastAppliedRevision).Should(Equal(first))
+
+			// Within the interval the same request does not fetch the new revision
+			second := commit("baa")
+
+			application = reconcile()
+			Expect(application.Status.LastHandledReconcileAt).Should(Equal("1"))
+			Expect(application.Status.LastAttemptedRevision).Should(Equal(first))
+			Expect(message()).Should(Equal("moo"))
+
+			update(func(application *gitopsv1.Application) {
+				application.Annotations[ReconcileRequestAnnotation] = "2"
+			})
+
+			application = reconcile()
+			Expect(application.Status.LastHandledReconcileAt).Should(Equal("2"))
+			Expect(application.Status.LastAppliedRevision).Should(Equal(second))
+			Expect(message()).Should(Equal("baa"))
+		})
+	})
+
+	Context("When the live objects drifted with the manual sync policy", func() {
+		var revision string
+
+		BeforeEach(func() {
+			revision = commit("moo")
+		})
+
+		// drift syncs the approved revision and changes the live ConfigMap behind the back of the controller
+		drift := func() {
+			Expect(reconcile().Status.LastAppliedRevision).Should(Equal(revision))
+
+			configMap := &corev1.ConfigMap{}
+			Expect(reconciler.Get(ctx, key, configMap)).Should(Succeed())
+			configMap.Data["message"] = "oink"
+			Expect(reconciler.Update(ctx, configMap)).Should(Succeed())
+		}
+
+		It("Should only report the drift", func() {
+			create(func(application *gitopsv1.Application) {
+				application.Spec.SyncPolicy = gitopsv1.SyncPolicyManual
+				application.Annotations = map[string]string{ApprovedRevisionAnnotation: revision}
+			})
+			drift()
+
+			application := reconcile()
+			Expect(meta.IsStatusConditionTrue(application.Status.Conditions, gitopsv1.DriftedCondition)).Should(BeTrue())
+			Expect(application.Status.Drift).Should(HaveLen(1))
+			Expect(application.Status.Drift[0].Fields).Should(ContainElement("data.message"))
+			Expect(message()).Should(Equal("oink"))
+		})
+
+		It("Should revert the drift if self-healing is enabled explicitly", func() {
+			create(func(application *gitopsv1.Application) {
+				selfHeal := true
+				application.Spec.SyncPolicy = gitopsv1.SyncPolicyManual
+				application.Spec.SelfHeal = &selfHeal
+				application.Annotations = map[string]string{ApprovedRevisionAnnotation: revision}
+			})
+			drift()
+
+			application := reconcile()
+			Expect(meta.IsStatusConditionTrue(application.Status.Conditions, gitopsv1.DriftedCondition)).Should(BeFalse())
+			Expect(message()).Should(Equal("moo"))
+		})
+	})
+
+	Context("When syncing a new revision", func() {
+		It("Should report the sync lifecycle with events", func() {
+			revision := commit("moo")
+			create(func(*gitopsv1.Application) {})
+
+			reconcile()
+
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+
+			Expect(events).Should(ContainElement("Normal " + gitopsv1.ClonedReason + " Cloned " + source + " at revision " + revision))
+			Expect(events).Should(ContainElement("Normal " + gitopsv1.CreatedReason + " Created ConfigMap default/cowsay at revision " + revision))
+			Expect(events).Should(ContainElement("Normal " + gitopsv1.HealthyReason + " Healthy at revision " + revision))
+		})
+	})
+})
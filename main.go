@@ -19,17 +19,24 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	gitopsv1 "github.com/uvegla/potato/api/v1"
 	"github.com/uvegla/potato/controllers"
@@ -52,11 +59,41 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var fieldManager string
+	var forceConflicts bool
+	var legacyFieldManagers string
+	var restrictNamespace bool
+	var defaultInterval time.Duration
+	var receiverAddr string
+	var receiverSecret string
+	var cacheDir string
+	var cacheMaxSize string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&fieldManager, "field-manager", controllers.DefaultFieldManager,
+		"The field manager name used when applying manifests with server-side apply.")
+	flag.BoolVar(&forceConflicts, "force-conflicts", false,
+		"Take over the ownership of conflicting fields managed by other field managers when applying manifests.")
+	flag.StringVar(&legacyFieldManagers, "legacy-field-managers", controllers.DefaultLegacyFieldManager,
+		"Comma separated field managers that updated the objects before server-side apply was used, their fields are "+
+			"taken over by the field manager when an object is applied the first time.")
+	flag.BoolVar(&restrictNamespace, "restrict-namespace", false,
+		"Only let Applications apply namespaced objects to their own namespace, refusing cluster-scoped objects "+
+			"and objects in other namespaces.")
+	flag.DurationVar(&defaultInterval, "default-interval", controllers.DefaultInterval,
+		"How often Applications without an interval of their own are synced.")
+	flag.StringVar(&receiverAddr, "receiver-bind-address", "",
+		"The address the Git webhook receiver binds to. The receiver is disabled if empty.")
+	flag.StringVar(&receiverSecret, "receiver-secret", "",
+		"The namespace/name of the Secret holding the token webhooks are validated with.")
+	flag.StringVar(&cacheDir, "cache-dir", controllers.DefaultCacheDir,
+		"The directory repositories are cached in, e.g. the mount point of a PersistentVolumeClaim.")
+	flag.StringVar(&cacheMaxSize, "cache-max-size", "0",
+		"The size the mirrors of the cached repositories may take up, e.g. 10Gi. The least recently used ones are evicted beyond it. "+
+			"The worktrees of the Applications are not counted. Unbounded if 0.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -67,8 +104,8 @@ func main() {
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
+		Metrics:                metricsserver.Options{BindAddress: metricsAddr},
+		WebhookServer:          webhook.NewServer(webhook.Options{Port: 9443}),
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "db348634.potato.io",
@@ -78,9 +115,43 @@ func main() {
 		os.Exit(1)
 	}
 
+	maxSize, err := resource.ParseQuantity(cacheMaxSize)
+	if err != nil {
+		setupLog.Error(err, "invalid --cache-max-size")
+		os.Exit(1)
+	}
+
+	var events chan event.GenericEvent
+	if receiverAddr != "" {
+		secretName := strings.SplitN(receiverSecret, "/", 2)
+		if len(secretName) != 2 || secretName[0] == "" || secretName[1] == "" {
+			setupLog.Error(nil, "--receiver-secret must be given as namespace/name when the receiver is enabled")
+			os.Exit(1)
+		}
+
+		events = make(chan event.GenericEvent)
+		if err := mgr.Add(&controllers.Receiver{
+			Client:     mgr.GetClient(),
+			Address:    receiverAddr,
+			SecretName: types.NamespacedName{Namespace: secretName[0], Name: secretName[1]},
+			Events:     events,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up webhook receiver")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controllers.ApplicationReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:              mgr.GetClient(),
+		Scheme:              mgr.GetScheme(),
+		FieldManager:        fieldManager,
+		ForceConflicts:      forceConflicts,
+		LegacyFieldManagers: splitList(legacyFieldManagers),
+		RestrictNamespace:   restrictNamespace,
+		Recorder:            mgr.GetEventRecorderFor("application-controller"),
+		DefaultInterval:     defaultInterval,
+		Events:              events,
+		Cache:               controllers.NewRepositoryCache(cacheDir, maxSize.Value()),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Application")
 		os.Exit(1)
@@ -102,3 +173,15 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated flag, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}